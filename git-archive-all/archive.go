@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// entry is a file or directory to be written to the archive.
+type entry struct {
+	path   string // path inside the archive, without the prefix
+	mode   uint32 // git mode of the entry
+	sha    string // blob holding the content (files and symlinks)
+	repo   *repo  // repository holding the blob
+	commit string // commit to expand $Format:...$ placeholders with (export-subst)
+	file   string // file on disk holding the content (--worktree)
+	data   []byte // content of generated files (manifest)
+}
+
+// collect appends to entries the content of the tree of repository r,
+// recursing into submodules at their recorded gitlink SHA.
+// commit is the commit tree comes from, if any. Entries are filtered and
+// marked for substitution according to the export-ignore and export-subst
+// attributes of r itself, so each submodule obeys its own .gitattributes.
+func collect(r *repo, tree, commit string, entries []entry) ([]entry, error) {
+	tes, err := r.lsTree(tree)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := r.exportAttrs(tree, tes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, te := range tes {
+		if isExportIgnored(attrs, te.path) {
+			printf("export-ignore [%s]\n", path.Join(r.path, te.path))
+			continue
+		}
+		name := path.Join(r.path, te.path)
+		switch te.mode {
+		case modeGitlink:
+			// same as git-check-clean: 160000 entries are submodules
+			info, err := r.moduleInfo(te.path, tree)
+			if err != nil {
+				return nil, err
+			}
+			if isSubmoduleExcluded(name, info.name) {
+				printf("excluding submodule [%s]\n", name)
+				continue
+			}
+			if !mayMatchPathspecs(name) {
+				continue
+			}
+			sub, err := r.submodule(te, tree)
+			if err != nil {
+				return nil, err
+			}
+			if sub.missing != "" {
+				entries = append(entries, placeholder(sub)...)
+				continue
+			}
+			printf("found submodule [%s] (%s)\n", sub.path, te.sha)
+			entries = append(entries, entry{path: name, mode: modeTree})
+			entries, err = collect(sub, te.sha, te.sha, entries)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			e := entry{
+				path: name,
+				mode: te.mode,
+				sha:  te.sha,
+				repo: r,
+			}
+			if attrs[te.path].subst && te.mode != modeTree {
+				// git-archive only expands placeholders when archiving a commit
+				e.commit = commit
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// placeholderName is the file standing for a missing submodule.
+const placeholderName = "MISSING-SUBMODULE.txt"
+
+// placeholder returns the entries standing for the missing submodule sub:
+// its directory, holding a file telling which sources are missing.
+func placeholder(sub *repo) []entry {
+	data := fmt.Sprintf(
+		"submodule %s (url=%s) at commit %s was not available when this archive was made: %s\n",
+		sub.name, sub.url, sub.gitlink, sub.missing,
+	)
+	return []entry{
+		{path: sub.path, mode: modeTree},
+		{path: path.Join(sub.path, placeholderName), mode: modeFile, data: []byte(data)},
+	}
+}
+
+// isExportIgnored returns whether name or one of its parent directories
+// has the export-ignore attribute.
+func isExportIgnored(attrs map[string]exportAttr, name string) bool {
+	for ; name != "." && name != "/"; name = path.Dir(name) {
+		if attrs[name].ignore {
+			return true
+		}
+	}
+	return false
+}
+
+// sortEntries sorts entries by their path inside the archive, so the order
+// does not depend on where submodule boundaries lie.
+func sortEntries(entries []entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].path < entries[j].path
+	})
+}
+
+// perm returns the permission bits of an archive entry, derived from its
+// git mode.
+func perm(mode uint32) int64 {
+	switch mode {
+	case modeTree, modeExec:
+		return 0755
+	case modeSymlink:
+		return 0777
+	}
+	return 0644
+}
+
+// writeArchive writes entries to the archiver a.
+func writeArchive(a archiver, entries []entry, prefix string, mtime time.Time) error {
+	for _, e := range entries {
+		name := prefix + e.path
+		switch e.mode {
+		case modeTree:
+			err := a.dir(name, perm(e.mode), mtime)
+			if err != nil {
+				return err
+			}
+
+		case modeSymlink:
+			var target []byte
+			var err error
+			if e.file != "" {
+				var link string
+				link, err = os.Readlink(e.file)
+				target = []byte(link)
+			} else {
+				target, err = e.repo.readBlob(e.sha)
+			}
+			if err != nil {
+				return fmt.Errorf("could not archive [%s]: %v", e.path, err)
+			}
+			err = a.symlink(name, string(target), mtime)
+			if err != nil {
+				return err
+			}
+
+		case modeFile, modeExec:
+			if e.data != nil {
+				err := a.file(name, perm(e.mode), mtime, int64(len(e.data)), bytes.NewReader(e.data))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if e.file != "" {
+				err := writeFile(a, name, e, mtime)
+				if err != nil {
+					return fmt.Errorf("could not archive [%s]: %v", e.path, err)
+				}
+				continue
+			}
+			if e.commit != "" {
+				data, err := e.repo.readBlob(e.sha)
+				if err == nil {
+					data, err = e.repo.expandSubst(e.commit, data)
+				}
+				if err == nil {
+					err = a.file(name, perm(e.mode), mtime, int64(len(data)), bytes.NewReader(data))
+				}
+				if err != nil {
+					return fmt.Errorf("could not archive [%s]: %v", e.path, err)
+				}
+				continue
+			}
+			err := e.repo.blob(e.sha, func(size int64, data io.Reader) error {
+				return a.file(name, perm(e.mode), mtime, size, data)
+			})
+			if err != nil {
+				return fmt.Errorf("could not archive [%s]: %v", e.path, err)
+			}
+
+		default:
+			return fmt.Errorf("unsupported mode %06o for [%s]", e.mode, e.path)
+		}
+	}
+	return a.Close()
+}
+
+// writeFile adds to a the content of the file on disk of entry e.
+func writeFile(a archiver, name string, e entry, mtime time.Time) error {
+	f, err := os.Open(e.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return a.file(name, perm(e.mode), mtime, fi.Size(), io.LimitReader(f, fi.Size()))
+}
+
+// EOF
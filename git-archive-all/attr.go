@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// exportAttr holds the .gitattributes git-archive cares about.
+type exportAttr struct {
+	ignore bool // export-ignore: leave the path out of the archive
+	subst  bool // export-subst: expand $Format:...$ placeholders
+}
+
+// exportAttrs returns the export attributes of the entries of a tree, as
+// defined by the .gitattributes files of that very tree (and the
+// repository's info/attributes), like git-archive does.
+// If tree is empty, the .gitattributes files of the working tree are used.
+// Directories are looked up with a trailing slash so "dir/" patterns match.
+func (r *repo) exportAttrs(tree string, tes []treeEntry) (map[string]exportAttr, error) {
+	attrs := make(map[string]exportAttr, len(tes))
+	if len(tes) == 0 {
+		return attrs, nil
+	}
+
+	env := os.Environ()
+	args := []string{"check-attr", "-z", "--stdin"}
+	if tree != "" {
+		// check-attr only reads .gitattributes from the working tree or the
+		// index: load the tree into a temporary index.
+		idx, err := ioutil.TempFile("", "git-archive-all-index-")
+		if err != nil {
+			return nil, err
+		}
+		idx.Close()
+		defer os.Remove(idx.Name())
+		env = append(env, "GIT_INDEX_FILE="+idx.Name())
+
+		cmd := r.git("read-tree", tree)
+		cmd.Env = env
+		err = cmd.Run()
+		if err != nil {
+			return nil, fmt.Errorf("could not read tree [%s] in [%s]: %v", tree, r.label(), err)
+		}
+		args = append(args, "--cached")
+	}
+	args = append(args, "export-ignore", "export-subst")
+
+	var stdin bytes.Buffer
+	for _, te := range tes {
+		stdin.WriteString(attrPath(te))
+		stdin.WriteByte(0)
+	}
+
+	cmd := r.git(args...)
+	cmd.Env = env
+	cmd.Stdin = &stdin
+	bout, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not check attributes in [%s]: %v", r.label(), err)
+	}
+
+	// <path> NUL <attribute> NUL <info> NUL
+	fields := strings.Split(string(bout), "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		name := strings.TrimSuffix(fields[i], "/")
+		attr := attrs[name]
+		set := fields[i+2] == "set"
+		switch fields[i+1] {
+		case "export-ignore":
+			attr.ignore = set
+		case "export-subst":
+			attr.subst = set
+		}
+		attrs[name] = attr
+	}
+	return attrs, nil
+}
+
+func attrPath(te treeEntry) string {
+	if te.mode == modeTree {
+		return te.path + "/"
+	}
+	return te.path
+}
+
+var substRe = regexp.MustCompile(`\$Format:([^$]*)\$`)
+
+// expandSubst expands the $Format:...$ placeholders of data with the
+// pretty-format of commit, as git-archive does for export-subst files.
+func (r *repo) expandSubst(commit string, data []byte) ([]byte, error) {
+	var err error
+	out := substRe.ReplaceAllFunc(data, func(match []byte) []byte {
+		if err != nil {
+			return match
+		}
+		format := string(substRe.FindSubmatch(match)[1])
+		var bout []byte
+		bout, err = r.git(
+			"log", "-1", "--no-show-signature",
+			"--pretty=format:"+format, commit,
+		).Output()
+		return bout
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not expand placeholders in [%s]: %v", r.label(), err)
+	}
+	return out, nil
+}
+
+// EOF
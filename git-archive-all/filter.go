@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// stringList is a flag.Value collecting the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// pathspec is a pathspec given on the command line.
+type pathspec struct {
+	arg  string         // as given, relative to the current directory
+	spec string         // relative to the top of the superproject
+	re   *regexp.Regexp // what it matches
+}
+
+// g_pathspecs restricts the archive to the given paths. As with git, the
+// wildcards of a pathspec also match slashes: "*.txt" matches "a/b.txt".
+var g_pathspecs []pathspec
+
+// pathspecRegexp returns the regular expression matching the same paths as
+// the glob pattern spec, as git's wildmatch does without WM_PATHNAME.
+func pathspecRegexp(spec string) (*regexp.Regexp, error) {
+	re := "(?s)^"
+	for i := 0; i < len(spec); i++ {
+		switch spec[i] {
+		case '*':
+			re += ".*"
+		case '?':
+			re += "."
+		case '\\':
+			if i+1 == len(spec) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			i++
+			re += regexp.QuoteMeta(spec[i : i+1])
+		case '[':
+			end := strings.Index(spec[i+1:], "]")
+			if end == 0 {
+				// a leading ] is part of the class
+				if next := strings.Index(spec[i+2:], "]"); next >= 0 {
+					end = next + 1
+				} else {
+					end = -1
+				}
+			}
+			if end < 0 {
+				re += regexp.QuoteMeta("[")
+				continue
+			}
+			class := spec[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re += "[" + strings.Replace(class, `\`, `\\`, -1) + "]"
+			i += end + 1
+		default:
+			re += regexp.QuoteMeta(spec[i : i+1])
+		}
+	}
+	return regexp.Compile(re + "$")
+}
+
+// setPathspecs validates and cleans the pathspecs given on the command line,
+// which are relative to the directory prefix of the superproject (as given
+// by git rev-parse --show-prefix).
+func setPathspecs(prefix string, args []string) error {
+	g_pathspecs = nil
+	for _, arg := range args {
+		if path.IsAbs(arg) {
+			return fmt.Errorf("pathspec [%s] must be relative to the current directory", arg)
+		}
+		spec := path.Join(prefix, arg)
+		if spec == ".." || strings.HasPrefix(spec, "../") {
+			return fmt.Errorf("pathspec [%s] is outside the repository", arg)
+		}
+		if spec == "." {
+			// the whole tree
+			g_pathspecs = nil
+			return nil
+		}
+		re, err := pathspecRegexp(spec)
+		if err != nil {
+			return fmt.Errorf("invalid pathspec [%s]: %v", arg, err)
+		}
+		g_pathspecs = append(g_pathspecs, pathspec{arg: arg, spec: spec, re: re})
+	}
+	return nil
+}
+
+// matchPathspecs returns whether name, or one of its parent directories,
+// is matched by a pathspec.
+func matchPathspecs(name string) bool {
+	return len(g_pathspecs) == 0 || len(matchingPathspecs(name)) > 0
+}
+
+// matchingPathspecs returns the indices in g_pathspecs of the pathspecs
+// matching name or one of its parent directories.
+func matchingPathspecs(name string) []int {
+	var o []int
+	for i, spec := range g_pathspecs {
+		for p := name; p != "." && p != "/"; p = path.Dir(p) {
+			if spec.re.MatchString(p) {
+				o = append(o, i)
+				break
+			}
+		}
+	}
+	return o
+}
+
+// mayMatchPathspecs returns whether the directory dir may contain entries
+// matched by a pathspec, so submodules which can not are not even opened.
+func mayMatchPathspecs(dir string) bool {
+	if matchPathspecs(dir) {
+		return true
+	}
+	for _, spec := range g_pathspecs {
+		// only the part of the pathspec before the first wildcard is
+		// literal, the rest may match any number of directories
+		lit := spec.spec
+		if i := strings.IndexAny(lit, `*?[\`); i >= 0 {
+			lit = lit[:i]
+		}
+		if strings.HasPrefix(lit, dir+"/") || strings.HasPrefix(dir+"/", lit) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterPathspecs removes from entries what is not matched by a pathspec,
+// keeping the parent directories of what is. As with git, it fails if a
+// pathspec matches nothing.
+func filterPathspecs(entries []entry) ([]entry, error) {
+	if len(g_pathspecs) == 0 {
+		return entries, nil
+	}
+
+	matched := make([]bool, len(g_pathspecs))
+	keep := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		idx := matchingPathspecs(e.path)
+		if len(idx) == 0 {
+			continue
+		}
+		for _, i := range idx {
+			matched[i] = true
+		}
+		keep[e.path] = true
+		for dir := path.Dir(e.path); dir != "." && !keep[dir]; dir = path.Dir(dir) {
+			keep[dir] = true
+		}
+	}
+
+	for i, spec := range g_pathspecs {
+		if !matched[i] {
+			return nil, fmt.Errorf("pathspec [%s] did not match any files", spec.arg)
+		}
+	}
+
+	o := entries[:0]
+	for _, e := range entries {
+		if keep[e.path] {
+			o = append(o, e)
+		}
+	}
+	return o, nil
+}
+
+// g_exclude lists the patterns of submodules to leave out of the archive.
+var g_exclude stringList
+
+// isSubmoduleExcluded returns whether the submodule with the given path
+// (relative to the superproject) and name is excluded by -exclude-submodule.
+func isSubmoduleExcluded(dir, name string) bool {
+	for _, pattern := range g_exclude {
+		pattern = strings.TrimSuffix(pattern, "/")
+		for _, v := range []string{dir, name} {
+			if ok, _ := path.Match(pattern, v); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EOF
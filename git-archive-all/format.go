@@ -0,0 +1,208 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// archiver writes entries in a given archive format.
+type archiver interface {
+	// dir adds a directory. name has no trailing slash.
+	dir(name string, mode int64, mtime time.Time) error
+	// symlink adds a symbolic link pointing to target.
+	symlink(name, target string, mtime time.Time) error
+	// file adds a regular file of the given size.
+	file(name string, mode int64, mtime time.Time, size int64, data io.Reader) error
+	// Close flushes the archive and the underlying compressor, if any.
+	Close() error
+}
+
+// formats maps a --format value to the suffixes it is guessed from.
+var formats = map[string][]string{
+	"tar":  {".tar"},
+	"tgz":  {".tar.gz", ".tgz"},
+	"txz":  {".tar.xz", ".txz"},
+	"tzst": {".tar.zst", ".tzst"},
+	"zip":  {".zip"},
+}
+
+// formatNames returns the list of supported formats.
+func formatNames() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// guessFormat returns the format to use for the output file fname, or "tar"
+// if it can not be guessed from the file extension.
+func guessFormat(fname string) string {
+	fname = strings.ToLower(fname)
+	for name, suffixes := range formats {
+		for _, suffix := range suffixes {
+			if strings.HasSuffix(fname, suffix) {
+				return name
+			}
+		}
+	}
+	return "tar"
+}
+
+// newArchiver returns an archiver writing the given format to w.
+// Compressors are configured with fixed settings (and a single encoder
+// goroutine) so the same entries always produce the same bytes.
+func newArchiver(format string, w io.Writer) (archiver, error) {
+	switch format {
+	case "tar":
+		return newTarArchiver(w, nil), nil
+	case "tgz":
+		// no file name nor modification time in the gzip header
+		zw, err := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		return newTarArchiver(zw, zw), nil
+	case "txz":
+		zw, err := xz.WriterConfig{CheckSum: xz.CRC64}.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return newTarArchiver(zw, zw), nil
+	case "tzst":
+		zw, err := zstd.NewWriter(
+			w,
+			zstd.WithEncoderLevel(zstd.SpeedDefault),
+			zstd.WithEncoderConcurrency(1),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return newTarArchiver(zw, zw), nil
+	case "zip":
+		return &zipArchiver{zw: zip.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf(
+		"unknown archive format [%s] (expected one of %s)",
+		format, strings.Join(formatNames(), ", "),
+	)
+}
+
+// tarArchiver writes tar archives. As git-archive does, entries are owned by
+// root:root so the archive does not depend on who created it.
+type tarArchiver struct {
+	tw *tar.Writer
+	zw io.Closer // compressor, if any
+}
+
+func newTarArchiver(w io.Writer, zw io.Closer) *tarArchiver {
+	return &tarArchiver{tw: tar.NewWriter(w), zw: zw}
+}
+
+func (a *tarArchiver) header(typ byte, name string, mode int64, mtime time.Time) *tar.Header {
+	return &tar.Header{
+		Typeflag: typ,
+		Name:     name,
+		Mode:     mode,
+		ModTime:  mtime,
+		Uid:      0,
+		Gid:      0,
+		Uname:    "root",
+		Gname:    "root",
+	}
+}
+
+func (a *tarArchiver) dir(name string, mode int64, mtime time.Time) error {
+	return a.tw.WriteHeader(a.header(tar.TypeDir, name+"/", mode, mtime))
+}
+
+func (a *tarArchiver) symlink(name, target string, mtime time.Time) error {
+	hdr := a.header(tar.TypeSymlink, name, 0777, mtime)
+	hdr.Linkname = target
+	return a.tw.WriteHeader(hdr)
+}
+
+func (a *tarArchiver) file(name string, mode int64, mtime time.Time, size int64, data io.Reader) error {
+	hdr := a.header(tar.TypeReg, name, mode, mtime)
+	hdr.Size = size
+	err := a.tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(a.tw, data)
+	return err
+}
+
+func (a *tarArchiver) Close() error {
+	err := a.tw.Close()
+	if a.zw != nil {
+		if e := a.zw.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// zipArchiver writes zip archives. Modification times are stored in UTC,
+// as the MS-DOS time fields would otherwise depend on the local time zone.
+type zipArchiver struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchiver) dir(name string, mode int64, mtime time.Time) error {
+	hdr := &zip.FileHeader{
+		Name:     name + "/",
+		Method:   zip.Store,
+		Modified: mtime.UTC(),
+	}
+	hdr.SetMode(os.ModeDir | os.FileMode(mode))
+	_, err := a.zw.CreateHeader(hdr)
+	return err
+}
+
+func (a *zipArchiver) symlink(name, target string, mtime time.Time) error {
+	hdr := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: mtime.UTC(),
+	}
+	hdr.SetMode(os.ModeSymlink | 0777)
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, target)
+	return err
+}
+
+func (a *zipArchiver) file(name string, mode int64, mtime time.Time, size int64, data io.Reader) error {
+	hdr := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: mtime.UTC(),
+	}
+	hdr.SetMode(os.FileMode(mode))
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, data)
+	return err
+}
+
+func (a *zipArchiver) Close() error {
+	return a.zw.Close()
+}
+
+// EOF
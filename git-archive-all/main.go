@@ -1,36 +1,247 @@
 package main
 
-// import (
-// 	"flag"
-// 	"fmt"
-// 	"os"
-// 	"os/exec"
-// 	"path/filepath"
-// 	"strings"
-
-// 	"github.com/mana-fwk/git-tools/utils"
-// )
-
-// var (
-// 	g_no_commit = flag.Bool("no-commit", false, "do not commit the result")
-// 	g_verbose   = flag.Bool("verbose", false, "")
-// )
-
-// func debug(cmd *exec.Cmd) {
-// 	if *g_verbose {
-// 		dir := cmd.Dir
-// 		if dir == "" {
-// 			dir, _ = os.Getwd()
-// 		}
-// 		fmt.Printf(">>> %v (%s)\n", cmd.Args, dir)
-// 		cmd.Stdin = os.Stdin
-// 		cmd.Stdout = os.Stdout
-// 		cmd.Stderr = os.Stderr
-// 	}
-// }
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mana-fwk/git-tools/utils"
+)
+
+var (
+	g_prefix  = flag.String("prefix", "", "prepend <prefix> to each path in the archive (e.g. \"name-1.0/\")")
+	g_output  = flag.String("o", "", "write the archive to <file> (\"-\" for the standard output)")
+	g_format  = flag.String("format", "", "format of the archive (tar, tgz, txz, tzst or zip). guessed from the -o <file> extension by default")
+	g_verbose = flag.Bool("verbose", false, "")
+
+	g_manifest = flag.String("manifest", "", "add a JSON manifest of the superproject and submodule revisions at <path> in the archive")
+
+	g_checksum = flag.String("checksum", "", "write <file>.<algo> checksum files for a comma separated list of algorithms (sha1, sha256, sha512)")
+	g_sign     = flag.String("sign", "", "create a detached signature of the archive with \"gpg\" (<file>.asc) or \"ssh\" (<file>.sig)")
+	g_signkey  = flag.String("sign-key", "", "key to sign with: gpg key id, or ssh private key file")
+
+	g_allowmissing = flag.Bool("allow-missing", false, "archive placeholders for the submodules which are not initialized or whose commit is not available, instead of failing")
+
+	g_worktree  = flag.Bool("worktree", false, "archive the files of the working trees instead of a tree-ish")
+	g_untracked = flag.Bool("untracked", false, "with -worktree, also archive untracked files which are not ignored")
+)
+
+func init() {
+	flag.Var(&g_exclude, "exclude-submodule", "leave out the submodules whose path or name matches <pattern> (may be repeated)")
+}
+
+func printf(format string, args ...interface{}) (n int, err error) {
+	if *g_verbose {
+		return fmt.Fprintf(os.Stderr, format, args...)
+	}
+	return
+}
+
+func debug(cmd *exec.Cmd) {
+	if *g_verbose {
+		dir := cmd.Dir
+		if dir == "" {
+			dir, _ = os.Getwd()
+		}
+		printf(">>> %v (%s)\n", cmd.Args, dir)
+	}
+}
 
 func main() {
+	flag.Parse()
+	var err error
+
+	// [<tree-ish>] [--] [<pathspec>...]
+	args := flag.Args()
+	pathspecs := []string{}
+	if n := len(os.Args) - len(args) - 1; n > 0 && os.Args[n] == "--" {
+		// flag consumed the "--" right after the options
+		pathspecs, args = args, nil
+	} else {
+		for i, arg := range args {
+			if arg == "--" {
+				pathspecs, args = args[i+1:], args[:i]
+				break
+			}
+		}
+	}
+	// like git, resolve the pathspecs against the current directory
+	bout, err := exec.Command("git", "rev-parse", "--show-prefix").Output()
+	utils.HandleErr(err)
+	err = setPathspecs(strings.Trim(string(bout), " \r\n"), pathspecs)
+	utils.HandleErr(err)
+
+	treeish := "HEAD"
+	switch len(args) {
+	case 0:
+		// ok
+	case 1:
+		if *g_worktree {
+			err = fmt.Errorf("no tree-ish expected with -worktree")
+			utils.HandleErr(err)
+		}
+		treeish = args[0]
+	default:
+		err = fmt.Errorf("you need to give at most one tree-ish to archive (pathspecs go after \"--\")")
+		utils.HandleErr(err)
+	}
+
+	if *g_output == "" {
+		err = fmt.Errorf("you need to give an output file (-o <file>, or -o - for the standard output)")
+		utils.HandleErr(err)
+	}
+
+	format := *g_format
+	if format == "" {
+		format = guessFormat(*g_output)
+	}
+	if _, ok := formats[format]; !ok {
+		err = fmt.Errorf(
+			"unknown archive format [%s] (expected one of %s)",
+			format, strings.Join(formatNames(), ", "),
+		)
+		utils.HandleErr(err)
+	}
+	printf("format [%s]\n", format)
+
+	stdout := *g_output == "-"
+	if stdout && (*g_checksum != "" || *g_sign != "") {
+		err = fmt.Errorf("-checksum and -sign need an output file")
+		utils.HandleErr(err)
+	}
+
+	sums, err := newChecksums(*g_checksum)
+	utils.HandleErr(err)
+
+	switch *g_sign {
+	case "", "gpg":
+		// ok
+	case "ssh":
+		if *g_signkey == "" {
+			err = fmt.Errorf("signing with ssh needs a key file (-sign-key=<file>)")
+			utils.HandleErr(err)
+		}
+	default:
+		err = fmt.Errorf("unknown signing method [%s] (expected gpg or ssh)", *g_sign)
+		utils.HandleErr(err)
+	}
+
+	super, err := openSuperproject()
+	utils.HandleErr(err)
+	defer super.close()
+
+	printf("gitdir [%s]\n", super.gitdir)
+
+	// like git-archive, use the commit time when archiving a commit and the
+	// current time when archiving a bare tree or the working tree.
+	// SOURCE_DATE_EPOCH (https://reproducible-builds.org) overrides both.
+	mtime := time.Now()
+	var entries []entry
+	var tree, commit string
+	if *g_worktree {
+		entries, err = collectWorktree(super, *g_untracked, nil)
+		utils.HandleErr(err)
+	} else {
+		tree, err = super.revParse(treeish + "^{tree}")
+		utils.HandleErr(err)
+
+		commit, err = super.revParse(treeish + "^{commit}")
+		if err == nil {
+			mtime, err = super.commitTime(commit)
+			utils.HandleErr(err)
+		} else {
+			commit = ""
+		}
+
+		entries, err = collect(super, tree, commit, nil)
+		utils.HandleErr(err)
+	}
+	entries, err = filterPathspecs(entries)
+	utils.HandleErr(err)
+
+	// fail before writing anything rather than produce a truncated archive
+	if missing := super.missingSubmodules(); len(missing) > 0 {
+		for _, sub := range missing {
+			fmt.Fprintf(os.Stderr, "submodule [%s] (url=%s): %s\n", sub.path, sub.url, sub.missing)
+		}
+		if !*g_allowmissing {
+			err = fmt.Errorf("%d submodule(s) not available. use -allow-missing to archive placeholders instead", len(missing))
+			utils.HandleErr(err)
+		}
+		fmt.Fprintf(os.Stderr, "**warning**: archiving placeholders for %d missing submodule(s)\n", len(missing))
+	}
+
+	if *g_manifest != "" {
+		m := newManifest(super, commit, tree)
+		entries, err = addManifest(entries, m, *g_manifest)
+		utils.HandleErr(err)
+	}
+	sortEntries(entries)
+
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		sec, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("invalid SOURCE_DATE_EPOCH [%s]", epoch)
+			utils.HandleErr(err)
+		}
+		mtime = time.Unix(sec, 0)
+	}
+	mtime = mtime.UTC()
+
+	if stdout {
+		w := bufio.NewWriter(os.Stdout)
+		a, err := newArchiver(format, w)
+		if err == nil {
+			err = writeArchive(a, entries, *g_prefix, mtime)
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		utils.HandleErr(err)
+		if super.isDirty() {
+			fmt.Fprintf(os.Stderr, "**warning**: archive of a dirty working tree\n")
+		}
+		return
+	}
+
+	f, err := os.Create(*g_output)
+	utils.HandleErr(err)
+
+	a, err := newArchiver(format, sums.writer(f))
+	if err == nil {
+		err = writeArchive(a, entries, *g_prefix, mtime)
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = sums.write(*g_output)
+	}
+	if err == nil && *g_sign != "" {
+		var sig string
+		sig, err = sign(*g_sign, *g_signkey, *g_output)
+		if err == nil {
+			printf("wrote [%s]\n", sig)
+		}
+	}
+	if err != nil {
+		os.Remove(*g_output)
+		for _, fname := range sums.files(*g_output) {
+			os.Remove(fname)
+		}
+		utils.HandleErr(err)
+	}
 
+	if super.isDirty() {
+		fmt.Fprintf(os.Stderr, "**warning**: [%s] is an archive of a dirty working tree\n", *g_output)
+	}
 }
 
-// EOF
\ No newline at end of file
+// EOF
@@ -0,0 +1,717 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mana-fwk/git-tools/utils"
+)
+
+func run_git(dir string, args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	bout, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %v: %v\noutput: %v", args, err, string(bout))
+	}
+	return nil
+}
+
+func get_gitroot() (string, error) {
+	// create temporary root tempdir
+	g_gitroot, err := ioutil.TempDir("", "git-archive-all-test-")
+	if err != nil {
+		return "", err
+	}
+
+	// sub-repo with a few files
+	err = run_git(g_gitroot, "init", "sub-repo")
+	if err != nil {
+		_ = os.RemoveAll(g_gitroot)
+		return "", err
+	}
+
+	subroot := filepath.Join(g_gitroot, "sub-repo")
+	err = os.MkdirAll(filepath.Join(subroot, "data"), 0755)
+	if err != nil {
+		_ = os.RemoveAll(g_gitroot)
+		return "", err
+	}
+	for fname, content := range map[string]string{
+		"file.txt":                        "this is a file in sub-repo\n",
+		filepath.Join("data", "data.txt"): "this is test data in sub-repo\n",
+		"version.txt":                     "$Format:%H$\n",
+		".gitattributes":                  "data/ export-ignore\nversion.txt export-subst\n",
+	} {
+		err = ioutil.WriteFile(
+			filepath.Join(subroot, fname),
+			[]byte(content),
+			0644,
+		)
+		if err != nil {
+			_ = os.RemoveAll(g_gitroot)
+			return "", err
+		}
+	}
+
+	for _, args := range [][]string{
+		{"add", "."},
+		{"commit", "-m", "adding files"},
+	} {
+		err = run_git(subroot, args...)
+		if err != nil {
+			_ = os.RemoveAll(g_gitroot)
+			return "", err
+		}
+	}
+
+	// super-repo with the sub-repo as a submodule
+	err = run_git(g_gitroot, "init", "work")
+	if err != nil {
+		_ = os.RemoveAll(g_gitroot)
+		return "", err
+	}
+
+	gitroot := filepath.Join(g_gitroot, "work")
+	err = ioutil.WriteFile(
+		filepath.Join(gitroot, "file.txt"),
+		[]byte("this is a file in work\n"),
+		0755,
+	)
+	if err != nil {
+		_ = os.RemoveAll(g_gitroot)
+		return "", err
+	}
+
+	for _, args := range [][]string{
+		{"add", "file.txt"},
+		{"-c", "protocol.file.allow=always", "submodule", "add", subroot, filepath.Join("src", "sub-repo")},
+		{"commit", "-m", "adding sub-repo"},
+	} {
+		err = run_git(gitroot, args...)
+		if err != nil {
+			_ = os.RemoveAll(g_gitroot)
+			return "", err
+		}
+	}
+
+	return g_gitroot, nil
+}
+
+func archive_digest(dir string, env []string, args ...string) (string, error) {
+	fname := filepath.Join(dir, "..", "archive.out")
+	defer os.Remove(fname)
+
+	args = append([]string{"archive-all", "-o", fname}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	bout, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %v: %v\noutput: %v", args, err, string(bout))
+	}
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 0 {
+		return "", fmt.Errorf("git %v: empty archive", args)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+func archive_entries(dir string, args ...string) (map[string]string, error) {
+	fname := filepath.Join(dir, "..", "archive.tar")
+	defer os.Remove(fname)
+
+	args = append([]string{"archive-all", "-format=tar", "-o", fname}, args...)
+	err := run_git(dir, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make(map[string]string)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		entries[hdr.Name] = string(data)
+	}
+	return entries, nil
+}
+
+func TestArchiveSubmodules(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+	subroot := filepath.Join(gitroot, "src", "sub-repo")
+
+	// a commit in the submodule, not recorded in the superproject
+	err = ioutil.WriteFile(filepath.Join(subroot, "file.txt"), []byte("not recorded\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = run_git(subroot, "commit", "-a", "-m", "not recorded")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := archive_entries(gitroot, "-prefix=name-1.0/", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	expected := []string{
+		"name-1.0/.gitmodules",
+		"name-1.0/file.txt",
+		"name-1.0/src/",
+		"name-1.0/src/sub-repo/",
+		"name-1.0/src/sub-repo/.gitattributes",
+		"name-1.0/src/sub-repo/file.txt",
+		"name-1.0/src/sub-repo/version.txt",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("got %v. expected %v\n", names, expected)
+	}
+
+	for name, content := range map[string]string{
+		"name-1.0/file.txt":              "this is a file in work\n",
+		"name-1.0/src/sub-repo/file.txt": "this is a file in sub-repo\n",
+	} {
+		if got := entries[name]; got != content {
+			t.Errorf("%s: got [%v]. expected [%v]\n", name, got, content)
+		}
+	}
+}
+
+func TestReproducibleArchive(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+
+	for _, format := range []string{"tar", "tgz", "txz", "tzst", "zip"} {
+		args := []string{"-format=" + format, "-prefix=work-1.0/"}
+
+		digest1, err := archive_digest(gitroot, []string{"TZ=UTC"}, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// touch the checked out files: only the committed content matters
+		now := time.Now()
+		for _, fname := range []string{
+			"file.txt",
+			filepath.Join("src", "sub-repo", "file.txt"),
+		} {
+			err = os.Chtimes(filepath.Join(gitroot, fname), now, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		digest2, err := archive_digest(gitroot, []string{"TZ=Asia/Tokyo"}, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if digest1 != digest2 {
+			t.Errorf("format [%s]: archives differ (%s != %s)", format, digest1, digest2)
+		}
+
+		// SOURCE_DATE_EPOCH changes the content
+		digest3, err := archive_digest(gitroot, []string{"SOURCE_DATE_EPOCH=0"}, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digest1 == digest3 {
+			t.Errorf("format [%s]: SOURCE_DATE_EPOCH not taken into account", format)
+		}
+	}
+}
+
+func TestSubmoduleExportAttributes(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+
+	entries, err := archive_entries(gitroot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"file.txt", "src/sub-repo/file.txt", "src/sub-repo/version.txt"} {
+		if _, ok := entries[name]; !ok {
+			t.Errorf("[%s] is missing from the archive", name)
+		}
+	}
+
+	// export-ignore from the submodule's own .gitattributes
+	for _, name := range []string{"src/sub-repo/data/", "src/sub-repo/data/data.txt"} {
+		if _, ok := entries[name]; ok {
+			t.Errorf("[%s] should have been export-ignored", name)
+		}
+	}
+
+	// export-subst expands with the submodule commit, not the superproject one
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = filepath.Join(g_gitroot, "sub-repo")
+	bout, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := entries["src/sub-repo/version.txt"], string(bout); got != expected {
+		t.Errorf("got [%v]. expected [%v]\n", got, expected)
+	}
+}
+
+func TestWorktreeArchive(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+
+	// modify a tracked file and add an untracked one in the submodule
+	err = ioutil.WriteFile(
+		filepath.Join(gitroot, "file.txt"),
+		[]byte("modified file in work\n"),
+		0755,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(gitroot, "src", "sub-repo", "untracked.txt"),
+		[]byte("untracked file in sub-repo\n"),
+		0644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := archive_entries(gitroot, "-worktree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := entries["file.txt"], "modified file in work\n"; got != expected {
+		t.Errorf("got [%v]. expected [%v]\n", got, expected)
+	}
+	if _, ok := entries["src/sub-repo/untracked.txt"]; ok {
+		t.Errorf("untracked file archived without -untracked")
+	}
+
+	entries, err = archive_entries(gitroot, "-worktree", "-untracked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := entries["src/sub-repo/untracked.txt"], "untracked file in sub-repo\n"; got != expected {
+		t.Errorf("got [%v]. expected [%v]\n", got, expected)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+
+	entries, err := archive_entries(gitroot, "-manifest=meta/manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m manifest
+	err = json.Unmarshal([]byte(entries["meta/manifest.json"]), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = gitroot
+	bout, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := m.Commit, strings.TrimSpace(string(bout)); got != expected {
+		t.Errorf("got [%v]. expected [%v]\n", got, expected)
+	}
+
+	cmd = exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = filepath.Join(g_gitroot, "sub-repo")
+	bout, err = cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := manifestSubmodule{
+		Path: "src/sub-repo",
+		Name: "src/sub-repo",
+		URL:  filepath.Join(g_gitroot, "sub-repo"),
+		SHA:  strings.TrimSpace(string(bout)),
+	}
+	if len(m.Submodules) != 1 {
+		t.Fatalf("got %+v. expected [%+v]\n", m.Submodules, expected)
+	}
+	// no tag: describe falls back to the abbreviated commit
+	got := m.Submodules[0]
+	if !strings.HasPrefix(expected.SHA, got.Describe) || got.Describe == "" {
+		t.Errorf("invalid describe [%s] for [%s]", got.Describe, expected.SHA)
+	}
+	got.Describe = ""
+	if got != expected {
+		t.Errorf("got [%+v]. expected [%+v]\n", got, expected)
+	}
+}
+
+func TestWorktreeManifest(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+	subroot := filepath.Join(gitroot, "src", "sub-repo")
+
+	// the submodule is checked out ahead of its gitlink
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = subroot
+	bout, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitlink := strings.TrimSpace(string(bout))
+	err = ioutil.WriteFile(filepath.Join(subroot, "file.txt"), []byte("new commit\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = run_git(subroot, "commit", "-a", "-m", "new commit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = subroot
+	bout, err = cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := strings.TrimSpace(string(bout))
+
+	entries, err := archive_entries(gitroot, "-worktree", "-manifest=manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := entries["src/sub-repo/file.txt"], "new commit\n"; got != expected {
+		t.Errorf("got [%v]. expected [%v]\n", got, expected)
+	}
+
+	var m manifest
+	err = json.Unmarshal([]byte(entries["manifest.json"]), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Submodules) != 1 {
+		t.Fatalf("unexpected submodules: %+v", m.Submodules)
+	}
+	got := m.Submodules[0]
+	if got.SHA != head || got.Gitlink != gitlink || !got.Dirty || !m.Dirty {
+		t.Errorf("got [%+v] (dirty=%v). expected sha=%s gitlink=%s, dirty", got, m.Dirty, head, gitlink)
+	}
+	if describe := strings.TrimSuffix(got.Describe, "-dirty"); describe == "" || !strings.HasPrefix(head, describe) {
+		t.Errorf("invalid describe [%s] for [%s]", got.Describe, head)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+	fname := filepath.Join(g_gitroot, "work-1.0.tar.gz")
+
+	err = run_git(gitroot, "archive-all", "-checksum=sha256,sha512", "-o", fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for algo, sum := range map[string]string{
+		"sha256": fmt.Sprintf("%x", sha256.Sum256(data)),
+		"sha512": fmt.Sprintf("%x", sha512.Sum512(data)),
+	} {
+		got, err := ioutil.ReadFile(fname + "." + algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := sum + "  work-1.0.tar.gz\n"
+		if string(got) != expected {
+			t.Errorf("%s: got [%v]. expected [%v]\n", algo, string(got), expected)
+		}
+	}
+}
+
+func TestFailedSignature(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+	fname := filepath.Join(g_gitroot, "work-1.0.tar.gz")
+
+	// an ssh-keygen which fails after writing part of the signature
+	bin := filepath.Join(g_gitroot, "bin")
+	err = os.Mkdir(bin, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(bin, "ssh-keygen"),
+		[]byte("#!/bin/sh\nfor f; do :; done\necho partial > \"$f.sig\"\nexit 1\n"),
+		0755,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("git", "archive-all", "-checksum=sha256", "-sign=ssh", "-sign-key=key", "-o", fname)
+	cmd.Dir = gitroot
+	cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	bout, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("archive-all should have failed to sign:\n%s", string(bout))
+	}
+	for _, out := range []string{fname, fname + ".sha256", fname + ".sig"} {
+		if utils.PathExists(out) {
+			t.Errorf("[%s] was not removed", out)
+		}
+	}
+}
+
+func TestPathspecsAndExcludedSubmodules(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+
+	for _, test := range []struct {
+		dir      string
+		args     []string
+		expected []string
+	}{
+		{
+			args:     []string{"--", "src/sub-repo/file.txt"},
+			expected: []string{"src/", "src/sub-repo/", "src/sub-repo/file.txt"},
+		},
+		{
+			// as with git, pathspecs are relative to the current directory
+			dir:      "src",
+			args:     []string{"--", "sub-repo/file.txt"},
+			expected: []string{"src/", "src/sub-repo/", "src/sub-repo/file.txt"},
+		},
+		{
+			dir:      "src",
+			args:     []string{"--", "."},
+			expected: []string{"src/", "src/sub-repo/", "src/sub-repo/.gitattributes", "src/sub-repo/file.txt", "src/sub-repo/version.txt"},
+		},
+		{
+			args:     []string{"HEAD", "--", "file.txt"},
+			expected: []string{"file.txt"},
+		},
+		{
+			// as with git, wildcards match across directories
+			args:     []string{"--", "*.txt"},
+			expected: []string{"file.txt", "src/", "src/sub-repo/", "src/sub-repo/file.txt", "src/sub-repo/version.txt"},
+		},
+		{
+			args:     []string{"--", "src/*/f?le.txt"},
+			expected: []string{"src/", "src/sub-repo/", "src/sub-repo/file.txt"},
+		},
+		{
+			args:     []string{"--", "[!f]*.txt"},
+			expected: []string{"src/", "src/sub-repo/", "src/sub-repo/file.txt", "src/sub-repo/version.txt"},
+		},
+		{
+			args:     []string{"-exclude-submodule=src/*"},
+			expected: []string{".gitmodules", "file.txt", "src/"},
+		},
+	} {
+		entries, err := archive_entries(filepath.Join(gitroot, test.dir), test.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("%v: got %v. expected %v\n", test.args, names, test.expected)
+		}
+	}
+
+	// as with git, a pathspec matching nothing is an error
+	fname := filepath.Join(g_gitroot, "nope.tar")
+	cmd := exec.Command("git", "archive-all", "-o", fname, "--", "file.txt", "nope")
+	cmd.Dir = gitroot
+	bout, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("archive-all should have failed on an unmatched pathspec:\n%s", string(bout))
+	}
+	if !strings.Contains(string(bout), "pathspec [nope] did not match any files") {
+		t.Errorf("unexpected output:\n%s", string(bout))
+	}
+	if utils.PathExists(fname) {
+		t.Errorf("[%s] was created", fname)
+	}
+}
+
+func TestBareSuperprojectToStdout(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+	bareroot := filepath.Join(g_gitroot, "bare.git")
+
+	// a bare copy of the superproject, submodules under modules/
+	err = exec.Command("cp", "-r", filepath.Join(gitroot, ".git"), bareroot).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = run_git(bareroot, "config", "core.bare", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := archive_digest(gitroot, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("git", "archive-all", "-o", "-")
+	cmd.Dir = bareroot
+	bout, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprintf("%x", sha256.Sum256(bout))
+	if got != expected {
+		t.Errorf("archive of bare superproject differs (%s != %s)", got, expected)
+	}
+}
+
+func TestMissingSubmoduleCommit(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+
+	// record a gitlink to a commit which does not exist
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	for _, args := range [][]string{
+		{"update-index", "--cacheinfo", "160000," + sha + ",src/sub-repo"},
+		{"commit", "-m", "bogus gitlink"},
+	} {
+		err = run_git(gitroot, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fname := filepath.Join(g_gitroot, "archive.tar")
+	err = run_git(gitroot, "archive-all", "-o", fname)
+	if err == nil {
+		t.Fatalf("archive-all should have failed on a missing submodule commit")
+	}
+	if utils.PathExists(fname) {
+		t.Errorf("archive [%s] should not have been written", fname)
+	}
+
+	entries, err := archive_entries(gitroot, "-allow-missing", "-manifest=manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entries["src/sub-repo/"+placeholderName]; !ok {
+		t.Errorf("no placeholder for the missing submodule")
+	}
+	if _, ok := entries["src/sub-repo/file.txt"]; ok {
+		t.Errorf("content of the missing submodule should not be archived")
+	}
+
+	var m manifest
+	err = json.Unmarshal([]byte(entries["manifest.json"]), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Submodules) != 1 || m.Submodules[0].Missing == "" || m.Submodules[0].SHA != sha {
+		t.Errorf("missing submodule not recorded in the manifest: %+v", m.Submodules)
+	}
+}
+
+// EOF
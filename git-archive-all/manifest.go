@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+)
+
+// manifest describes the sources an archive was made from, so an archive
+// can be traced back to its sources without the .git directories.
+type manifest struct {
+	Commit     string              `json:"commit,omitempty"`
+	Tree       string              `json:"tree,omitempty"`
+	Describe   string              `json:"describe,omitempty"`
+	Dirty      bool                `json:"dirty,omitempty"`
+	Submodules []manifestSubmodule `json:"submodules"`
+}
+
+// manifestSubmodule describes one (possibly nested) submodule.
+type manifestSubmodule struct {
+	Path     string `json:"path"`
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	SHA      string `json:"sha"`               // the archived commit
+	Gitlink  string `json:"gitlink,omitempty"` // the recorded one, if it differs
+	Describe string `json:"describe,omitempty"`
+	Dirty    bool   `json:"dirty,omitempty"`
+	Missing  string `json:"missing,omitempty"`
+}
+
+// newManifest returns the manifest of the superproject r archived at
+// commit/tree (both empty when archiving the working tree), and of all the
+// submodules opened while collecting the archive entries.
+func newManifest(r *repo, commit, tree string) *manifest {
+	m := &manifest{
+		Commit:     commit,
+		Tree:       tree,
+		Dirty:      r.dirty,
+		Submodules: []manifestSubmodule{},
+	}
+
+	worktree := commit == "" && tree == ""
+	if worktree {
+		// the checked out commit, if any
+		m.Commit, _ = r.revParse("HEAD")
+	}
+	if m.Commit != "" {
+		m.Describe = r.describe(m.Commit, worktree)
+	}
+
+	var walk func(r *repo)
+	walk = func(r *repo) {
+		for _, sub := range r.sub {
+			ms := manifestSubmodule{
+				Path:    sub.path,
+				Name:    sub.name,
+				URL:     sub.url,
+				SHA:     sub.gitlink,
+				Dirty:   sub.dirty,
+				Missing: sub.missing,
+			}
+			if sub.missing == "" && worktree {
+				// the checked out commit is archived, not the recorded one
+				if head, err := sub.revParse("HEAD"); err == nil && head != sub.gitlink {
+					ms.SHA = head
+					ms.Gitlink = sub.gitlink
+					ms.Dirty = true
+					m.Dirty = true
+				}
+			}
+			if sub.missing == "" {
+				ms.Describe = sub.describe(ms.SHA, worktree)
+			}
+			m.Submodules = append(m.Submodules, ms)
+			walk(sub)
+		}
+	}
+	walk(r)
+
+	sort.Slice(m.Submodules, func(i, j int) bool {
+		return m.Submodules[i].Path < m.Submodules[j].Path
+	})
+	return m
+}
+
+// describe returns the 'git describe' output for rev, or an empty string
+// if it can not be described. With worktree, a dirty working tree is
+// flagged with a "-dirty" suffix.
+func (r *repo) describe(rev string, worktree bool) string {
+	args := []string{"describe", "--always"}
+	if worktree {
+		args = append(args, "--dirty")
+	} else {
+		args = append(args, rev)
+	}
+	out, err := r.output(args...)
+	if err != nil {
+		return ""
+	}
+	return out
+}
+
+// addManifest adds to entries the JSON manifest m at path name, along with
+// its missing parent directories.
+func addManifest(entries []entry, m *manifest, name string) ([]entry, error) {
+	name = path.Clean("/" + name)[1:]
+	if name == "" {
+		return nil, fmt.Errorf("invalid manifest path")
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, '\n')
+
+	exists := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		exists[e.path] = true
+	}
+	if exists[name] {
+		return nil, fmt.Errorf("manifest [%s] would overwrite an archived file", name)
+	}
+
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if !exists[dir] {
+			exists[dir] = true
+			entries = append(entries, entry{path: dir, mode: modeTree})
+		}
+	}
+	entries = append(entries, entry{path: name, mode: modeFile, data: data})
+	return entries, nil
+}
+
+// EOF
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mana-fwk/git-tools/utils"
+)
+
+// git file modes, as printed by 'git ls-tree' and 'git ls-files --stage'
+const (
+	modeTree    = 0040000
+	modeFile    = 0100644
+	modeExec    = 0100755
+	modeSymlink = 0120000
+	modeGitlink = 0160000
+)
+
+// repo is a repository taking part in the archive: the superproject or one
+// of its (possibly nested) submodules.
+type repo struct {
+	path   string // path of the repository, relative to the superproject
+	dir    string // working tree of the repository, if any
+	gitdir string // absolute path to the git directory
+	dirty  bool   // working tree flagged by git-check-clean (--worktree)
+
+	name    string // name of the submodule, from .gitmodules
+	url     string // url of the submodule, from .gitmodules
+	gitlink string // commit of the submodule recorded in its superproject
+	missing string // why the submodule can not be archived, if it can not
+
+	modules map[string]submoduleInfo // .gitmodules entries, by path
+
+	cat *catFile // lazily started 'git cat-file --batch'
+	sub []*repo  // submodules opened from this repository
+}
+
+// treeEntry is one line of 'git ls-tree' output.
+type treeEntry struct {
+	mode uint32
+	typ  string
+	sha  string
+	path string
+}
+
+// openSuperproject opens the repository of the current working directory,
+// which may be a bare repository.
+func openSuperproject() (*repo, error) {
+	bout, err := exec.Command("git", "rev-parse", "--git-dir").Output()
+	if err != nil {
+		return nil, err
+	}
+	gitdir, err := filepath.Abs(strings.Trim(string(bout), " \r\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	bout, err = exec.Command("git", "rev-parse", "--is-bare-repository").Output()
+	if err != nil {
+		return nil, err
+	}
+	if strings.Trim(string(bout), " \r\n") == "true" {
+		return &repo{gitdir: gitdir}, nil
+	}
+
+	bout, err = exec.Command("git", "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return nil, err
+	}
+	top, err := filepath.Abs(strings.Trim(string(bout), " \r\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &repo{dir: top, gitdir: gitdir}, nil
+}
+
+// git returns a git command operating on this repository.
+func (r *repo) git(args ...string) *exec.Cmd {
+	opts := []string{"--git-dir=" + r.gitdir}
+	if r.dir == "" {
+		// the git dir of a submodule of a bare superproject still has a
+		// core.worktree pointing to a missing directory: override it.
+		opts = append(opts, "--work-tree="+r.gitdir)
+	}
+	args = append(opts, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.gitdir
+	if r.dir != "" {
+		cmd.Dir = r.dir
+	}
+	debug(cmd)
+	return cmd
+}
+
+// output runs a git command and returns its trimmed standard output.
+func (r *repo) output(args ...string) (string, error) {
+	bout, err := r.git(args...).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(string(bout), " \r\n"), nil
+}
+
+// revParse resolves a revision to an object name.
+func (r *repo) revParse(rev string) (string, error) {
+	sha, err := r.output("rev-parse", "--verify", "--quiet", rev)
+	if err != nil {
+		return "", fmt.Errorf("no such revision [%s] in [%s]", rev, r.label())
+	}
+	return sha, nil
+}
+
+// commitTime returns the committer date of a commit.
+func (r *repo) commitTime(commit string) (time.Time, error) {
+	out, err := r.output("log", "-1", "--format=%ct", commit)
+	if err != nil {
+		return time.Time{}, err
+	}
+	sec, err := strconv.ParseInt(out, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// label returns a human readable name for the repository.
+func (r *repo) label() string {
+	if r.path == "" {
+		return "."
+	}
+	return r.path
+}
+
+// lsTree lists recursively the content of a tree, including sub-trees.
+func (r *repo) lsTree(tree string) ([]treeEntry, error) {
+	bout, err := r.git("ls-tree", "-r", "-t", "-z", "--full-tree", tree).Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not list tree [%s] in [%s]: %v", tree, r.label(), err)
+	}
+
+	entries := []treeEntry{}
+	for _, line := range strings.Split(string(bout), "\x00") {
+		if line == "" {
+			continue
+		}
+		// <mode> SP <type> SP <object> TAB <file>
+		tab := strings.Index(line, "\t")
+		if tab < 0 {
+			return nil, fmt.Errorf("invalid ls-tree line [%s]", line)
+		}
+		fields := strings.Fields(line[:tab])
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid ls-tree line [%s]", line)
+		}
+		mode, err := strconv.ParseUint(fields[0], 8, 32)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, treeEntry{
+			mode: uint32(mode),
+			typ:  fields[1],
+			sha:  fields[2],
+			path: line[tab+1:],
+		})
+	}
+	return entries, nil
+}
+
+// submoduleInfo is a submodule entry of a .gitmodules file.
+type submoduleInfo struct {
+	name string
+	url  string
+}
+
+// gitmodules returns the submodules declared in the .gitmodules file of
+// tree (or of the working tree if tree is empty), indexed by path.
+func (r *repo) gitmodules(tree string) (map[string]submoduleInfo, error) {
+	mods := make(map[string]submoduleInfo)
+
+	args := []string{"config", "-z"}
+	if tree == "" {
+		fname := filepath.Join(r.dir, ".gitmodules")
+		if !utils.PathExists(fname) {
+			return mods, nil
+		}
+		args = append(args, "-f", fname)
+	} else {
+		blob := tree + ":.gitmodules"
+		if _, err := r.revParse(blob); err != nil {
+			return mods, nil
+		}
+		args = append(args, "--blob", blob)
+	}
+	args = append(args, "--get-regexp", `^submodule\..*\.(path|url)$`)
+
+	bout, err := r.git(args...).Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 1 {
+			// no matching key
+			return mods, nil
+		}
+		return nil, fmt.Errorf("could not read .gitmodules of [%s]: %v", r.label(), err)
+	}
+
+	// submodule.<name>.<var> LF <value> NUL
+	paths := make(map[string]string)
+	urls := make(map[string]string)
+	for _, kv := range strings.Split(string(bout), "\x00") {
+		if kv == "" {
+			continue
+		}
+		key, value := kv, ""
+		if i := strings.Index(kv, "\n"); i >= 0 {
+			key, value = kv[:i], kv[i+1:]
+		}
+		dot := strings.LastIndex(key, ".")
+		name := key[len("submodule."):dot]
+		switch key[dot+1:] {
+		case "path":
+			paths[name] = value
+		case "url":
+			urls[name] = value
+		}
+	}
+	for name, p := range paths {
+		mods[p] = submoduleInfo{name: name, url: urls[name]}
+	}
+	return mods, nil
+}
+
+// moduleInfo returns the .gitmodules entry of the submodule at dir in tree
+// (or in the working tree, if tree is empty). The name defaults to dir when
+// the submodule is not declared.
+func (r *repo) moduleInfo(dir, tree string) (submoduleInfo, error) {
+	if r.modules == nil {
+		mods, err := r.gitmodules(tree)
+		if err != nil {
+			return submoduleInfo{}, err
+		}
+		r.modules = mods
+	}
+	info, ok := r.modules[dir]
+	if !ok {
+		info.name = dir
+	}
+	return info, nil
+}
+
+// submodule opens the submodule registered by the gitlink te of tree (or
+// of the index, if tree is empty). A submodule which is not initialized,
+// or whose recorded commit is not available, is returned with its missing
+// field set.
+func (r *repo) submodule(te treeEntry, tree string) (*repo, error) {
+	info, err := r.moduleInfo(te.path, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := te.path
+	sub := &repo{
+		path:    path.Join(r.path, dir),
+		name:    info.name,
+		url:     info.url,
+		gitlink: te.sha,
+	}
+
+	if r.dir != "" {
+		wdir := filepath.Join(r.dir, filepath.FromSlash(dir))
+		if utils.PathExists(filepath.Join(wdir, ".git")) {
+			cmd := exec.Command("git", "rev-parse", "--git-dir")
+			cmd.Dir = wdir
+			debug(cmd)
+			bout, err := cmd.Output()
+			if err != nil {
+				return nil, err
+			}
+			gitdir := strings.Trim(string(bout), " \r\n")
+			if !filepath.IsAbs(gitdir) {
+				gitdir = filepath.Join(wdir, gitdir)
+			}
+			sub.dir = wdir
+			sub.gitdir = gitdir
+		}
+	}
+
+	if sub.gitdir == "" {
+		// absorbed git dir, as in a bare superproject: <gitdir>/modules/<name>
+		// or, for repositories created by older versions of git, <path>.
+		for _, mod := range []string{sub.name, dir} {
+			gitdir := filepath.Join(r.gitdir, "modules", filepath.FromSlash(mod))
+			if utils.PathExists(gitdir) {
+				sub.gitdir = gitdir
+				break
+			}
+		}
+	}
+
+	switch {
+	case sub.gitdir == "":
+		sub.missing = "not initialized"
+	case tree != "" && !sub.hasCommit(te.sha):
+		sub.missing = fmt.Sprintf("commit %s not available", te.sha)
+	}
+
+	r.sub = append(r.sub, sub)
+	return sub, nil
+}
+
+// hasCommit returns whether the commit sha is in the object store of r.
+func (r *repo) hasCommit(sha string) bool {
+	return r.git("cat-file", "-e", sha+"^{commit}").Run() == nil
+}
+
+// missingSubmodules returns the submodules of r, recursively, which can
+// not be archived.
+func (r *repo) missingSubmodules() []*repo {
+	missing := []*repo{}
+	for _, sub := range r.sub {
+		if sub.missing != "" {
+			missing = append(missing, sub)
+		}
+		missing = append(missing, sub.missingSubmodules()...)
+	}
+	return missing
+}
+
+// blob calls fct with the size and content of a blob.
+func (r *repo) blob(sha string, fct func(size int64, data io.Reader) error) error {
+	if r.cat == nil {
+		cat, err := newCatFile(r)
+		if err != nil {
+			return err
+		}
+		r.cat = cat
+	}
+	return r.cat.blob(sha, fct)
+}
+
+// close releases the resources held by this repository and its submodules.
+func (r *repo) close() error {
+	var err error
+	for _, sub := range r.sub {
+		if e := sub.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if r.cat != nil {
+		if e := r.cat.close(); e != nil && err == nil {
+			err = e
+		}
+		r.cat = nil
+	}
+	return err
+}
+
+// catFile reads objects through a long running 'git cat-file --batch'.
+type catFile struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+func newCatFile(r *repo) (*catFile, error) {
+	cmd := r.git("cat-file", "--batch")
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &catFile{cmd: cmd, in: in, out: bufio.NewReader(out)}, nil
+}
+
+func (c *catFile) blob(sha string, fct func(size int64, data io.Reader) error) error {
+	_, err := fmt.Fprintf(c.in, "%s\n", sha)
+	if err != nil {
+		return err
+	}
+
+	// <sha> SP <type> SP <size> LF
+	hdr, err := c.out.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(hdr)
+	if len(fields) == 2 && fields[1] == "missing" {
+		return fmt.Errorf("missing object [%s]", sha)
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("invalid cat-file header [%s]", strings.TrimSpace(hdr))
+	}
+	if fields[1] != "blob" {
+		return fmt.Errorf("object [%s] is a %s, not a blob", sha, fields[1])
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	data := io.LimitReader(c.out, size)
+	err = fct(size, data)
+	if err != nil {
+		return err
+	}
+
+	// drain what fct did not consume, plus the trailing LF
+	_, err = io.Copy(ioutil.Discard, data)
+	if err != nil {
+		return err
+	}
+	_, err = c.out.Discard(1)
+	return err
+}
+
+func (c *catFile) close() error {
+	c.in.Close()
+	return c.cmd.Wait()
+}
+
+// readBlob returns the whole content of a blob.
+func (r *repo) readBlob(sha string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := r.blob(sha, func(size int64, data io.Reader) error {
+		_, err := io.Copy(&buf, data)
+		return err
+	})
+	return buf.Bytes(), err
+}
+
+// EOF
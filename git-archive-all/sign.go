@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// hashes maps a --checksum algorithm to its constructor.
+var hashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// checksums computes digests of the archive while it is being written.
+type checksums struct {
+	algos  []string
+	hashes []hash.Hash
+}
+
+// newChecksums returns the checksums for a comma separated list of
+// algorithms.
+func newChecksums(list string) (*checksums, error) {
+	c := &checksums{}
+	for _, algo := range strings.Split(list, ",") {
+		algo = strings.ToLower(strings.TrimSpace(algo))
+		if algo == "" {
+			continue
+		}
+		h, ok := hashes[algo]
+		if !ok {
+			return nil, fmt.Errorf("unknown checksum algorithm [%s] (expected sha1, sha256 or sha512)", algo)
+		}
+		c.algos = append(c.algos, algo)
+		c.hashes = append(c.hashes, h())
+	}
+	return c, nil
+}
+
+// writer returns w, also feeding all the digests.
+func (c *checksums) writer(w io.Writer) io.Writer {
+	if len(c.hashes) == 0 {
+		return w
+	}
+	ws := []io.Writer{w}
+	for _, h := range c.hashes {
+		ws = append(ws, h)
+	}
+	return io.MultiWriter(ws...)
+}
+
+// files returns the names of the checksum files of archive fname.
+func (c *checksums) files(fname string) []string {
+	names := make([]string, 0, len(c.algos))
+	for _, algo := range c.algos {
+		names = append(names, fname+"."+algo)
+	}
+	return names
+}
+
+// write writes the checksum files of archive fname, in the format of
+// sha256sum and friends, so they can be checked with 'sha256sum -c'.
+func (c *checksums) write(fname string) error {
+	for i, out := range c.files(fname) {
+		line := fmt.Sprintf("%x  %s\n", c.hashes[i].Sum(nil), filepath.Base(fname))
+		err := ioutil.WriteFile(out, []byte(line), 0644)
+		if err != nil {
+			return err
+		}
+		printf("wrote [%s]\n", out)
+	}
+	return nil
+}
+
+// sign creates a detached signature of archive fname, with gpg (into
+// <fname>.asc) or ssh-keygen (into <fname>.sig).
+func sign(method, key, fname string) (string, error) {
+	var cmd *exec.Cmd
+	var sig string
+	switch method {
+	case "gpg":
+		sig = fname + ".asc"
+		args := []string{"--yes", "--armor", "--detach-sign", "--output", sig}
+		if key != "" {
+			args = append(args, "--local-user", key)
+		}
+		args = append(args, fname)
+		cmd = exec.Command("gpg", args...)
+	case "ssh":
+		if key == "" {
+			return "", fmt.Errorf("signing with ssh needs a key file (-sign-key=<file>)")
+		}
+		sig = fname + ".sig"
+		// ssh-keygen refuses to overwrite an existing signature
+		err := os.Remove(sig)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		cmd = exec.Command("ssh-keygen", "-Y", "sign", "-f", key, "-n", "file", fname)
+	default:
+		return "", fmt.Errorf("unknown signing method [%s] (expected gpg or ssh)", method)
+	}
+
+	debug(cmd)
+	// the tools may need to ask for a passphrase
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		// do not leave a partial signature behind
+		os.Remove(sig)
+		return "", fmt.Errorf("could not sign [%s]: %v", fname, err)
+	}
+	return sig, nil
+}
+
+// EOF
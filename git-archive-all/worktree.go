@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// collectWorktree appends to entries the files checked out in the working
+// tree of repository r: the tracked ones and, if untracked is true, the
+// untracked ones which are not ignored. Submodules are recursed into, the
+// ones which are not checked out are replaced by placeholders.
+func collectWorktree(r *repo, untracked bool, entries []entry) ([]entry, error) {
+	if r.dir == "" {
+		return nil, fmt.Errorf("repository [%s] has no working tree", r.label())
+	}
+
+	dirty, err := checkClean(r)
+	if err != nil {
+		return nil, err
+	}
+	r.dirty = dirty
+
+	tes, err := r.lsFiles(untracked)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := r.exportAttrs("", tes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, te := range tes {
+		if isExportIgnored(attrs, te.path) {
+			printf("export-ignore [%s]\n", path.Join(r.path, te.path))
+			continue
+		}
+		name := path.Join(r.path, te.path)
+		switch te.mode {
+		case modeGitlink:
+			info, err := r.moduleInfo(te.path, "")
+			if err != nil {
+				return nil, err
+			}
+			if isSubmoduleExcluded(name, info.name) {
+				printf("excluding submodule [%s]\n", name)
+				continue
+			}
+			if !mayMatchPathspecs(name) {
+				continue
+			}
+			sub, err := r.submodule(te, "")
+			if err != nil {
+				return nil, err
+			}
+			if sub.missing == "" && sub.dir == "" {
+				sub.missing = "not checked out"
+			}
+			if sub.missing != "" {
+				entries = append(entries, placeholder(sub)...)
+				continue
+			}
+			printf("found submodule [%s]\n", sub.path)
+			entries = append(entries, entry{path: name, mode: modeTree})
+			entries, err = collectWorktree(sub, untracked, entries)
+			if err != nil {
+				return nil, err
+			}
+		case modeTree:
+			entries = append(entries, entry{path: name, mode: modeTree})
+		default:
+			entries = append(entries, entry{
+				path: name,
+				mode: te.mode,
+				file: filepath.Join(r.dir, filepath.FromSlash(te.path)),
+			})
+		}
+	}
+	return entries, nil
+}
+
+// lsFiles lists the files of the working tree of r which are in the index
+// (and, if untracked is true, the untracked files which are not ignored).
+// Modes are taken from the files on disk, and entries for their parent
+// directories are added. Files deleted from the working tree are skipped.
+func (r *repo) lsFiles(untracked bool) ([]treeEntry, error) {
+	bout, err := r.git("ls-files", "--stage", "-z").Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not list files in [%s]: %v", r.label(), err)
+	}
+
+	files := []treeEntry{}
+	for _, line := range strings.Split(string(bout), "\x00") {
+		if line == "" {
+			continue
+		}
+		// <mode> SP <object> SP <stage> TAB <file>
+		tab := strings.Index(line, "\t")
+		if tab < 0 {
+			return nil, fmt.Errorf("invalid ls-files line [%s]", line)
+		}
+		fields := strings.Fields(line[:tab])
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid ls-files line [%s]", line)
+		}
+		mode, err := strconv.ParseUint(fields[0], 8, 32)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, treeEntry{
+			mode: uint32(mode),
+			sha:  fields[1],
+			path: line[tab+1:],
+		})
+	}
+
+	if untracked {
+		bout, err = r.git("ls-files", "--others", "--exclude-standard", "-z").Output()
+		if err != nil {
+			return nil, fmt.Errorf("could not list untracked files in [%s]: %v", r.label(), err)
+		}
+		for _, name := range strings.Split(string(bout), "\x00") {
+			// nested repositories are listed as "dir/"
+			if name == "" || strings.HasSuffix(name, "/") {
+				continue
+			}
+			files = append(files, treeEntry{path: name})
+		}
+	}
+
+	tes := []treeEntry{}
+	seen := make(map[string]bool, len(files))
+	for _, f := range files {
+		// unmerged files have one index entry per stage
+		if seen[f.path] {
+			continue
+		}
+		seen[f.path] = true
+
+		if f.mode != modeGitlink {
+			fi, err := os.Lstat(filepath.Join(r.dir, filepath.FromSlash(f.path)))
+			if os.IsNotExist(err) {
+				printf("skipping deleted file [%s]\n", path.Join(r.path, f.path))
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case fi.Mode()&os.ModeSymlink != 0:
+				f.mode = modeSymlink
+			case fi.Mode().IsRegular() && fi.Mode()&0111 != 0:
+				f.mode = modeExec
+			case fi.Mode().IsRegular():
+				f.mode = modeFile
+			default:
+				printf("skipping [%s] (not a regular file)\n", path.Join(r.path, f.path))
+				continue
+			}
+		}
+
+		for dir := path.Dir(f.path); dir != "." && !seen[dir+"/"]; dir = path.Dir(dir) {
+			seen[dir+"/"] = true
+			tes = append(tes, treeEntry{mode: modeTree, path: dir})
+		}
+		tes = append(tes, f)
+	}
+	return tes, nil
+}
+
+// checkClean reports on stderr what git-check-clean flags in the working
+// tree of r, and returns whether it flagged anything.
+func checkClean(r *repo) (bool, error) {
+	cmd := exec.Command("git", "check-clean", "-warn")
+	cmd.Dir = r.dir
+	debug(cmd)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return false, fmt.Errorf("git check-clean failed in [%s]: %v", r.label(), err)
+	}
+	if stderr.Len() == 0 {
+		return false, nil
+	}
+	fmt.Fprintf(os.Stderr, "**warning**: working tree of [%s] is not clean:\n%s", r.label(), stderr.String())
+	return true, nil
+}
+
+// isDirty returns whether the working tree of r or of one of its
+// submodules was flagged by git-check-clean.
+func (r *repo) isDirty() bool {
+	if r.dirty {
+		return true
+	}
+	for _, sub := range r.sub {
+		if sub.isDirty() {
+			return true
+		}
+	}
+	return false
+}
+
+// EOF
@@ -1,13 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
 	// "path/filepath"
-	"regexp"
-	// "strings"
+	"strconv"
+	"strings"
 
 	"github.com/mana-fwk/git-tools/utils"
 )
@@ -20,6 +21,8 @@ var (
 	g_unmerged    = flag.Bool("unmerged", true, "check for unmerged files")
 	g_ignoresub   = flag.String("ignore-submodules", "", "ignore submodules, optionally specifying defaults to \"all\"")
 	g_warn        = flag.Bool("warn", false, "do not issue an error, but just a warning")
+	g_list        = flag.Bool("list", false, "list the offending files, grouped by category")
+	g_format      = flag.String("format", "text", "output format (text or json)")
 )
 
 var g_output bool = false
@@ -29,6 +32,160 @@ func output(msg string) {
 	fmt.Fprint(os.Stderr, msg)
 }
 
+// categories are the kinds of offending files, in the order they are
+// listed with -list.
+var categories = []string{"unstaged", "uncommitted", "untracked", "unmerged", "submodules"}
+
+// categorize returns the entries of each category. A file can be in both
+// the unstaged and uncommitted ones. A submodule with tracked changes or
+// untracked files in its working tree is in the submodules one, and one
+// which only has another commit checked out is unstaged.
+func categorize(entries []statusEntry) map[string][]statusEntry {
+	cats := make(map[string][]statusEntry)
+	for _, e := range entries {
+		switch e.kind {
+		case kindUntracked:
+			cats["untracked"] = append(cats["untracked"], e)
+		case kindIgnored:
+			// ignored
+		case kindUnmerged:
+			cats["unmerged"] = append(cats["unmerged"], e)
+		case kindOrdinary, kindRenameCopy:
+			if e.xy[0] != '.' {
+				cats["uncommitted"] = append(cats["uncommitted"], e)
+			}
+			if e.xy[1] == '.' {
+				continue
+			}
+			if e.sub.modified || e.sub.untracked {
+				cats["submodules"] = append(cats["submodules"], e)
+			} else {
+				cats["unstaged"] = append(cats["unstaged"], e)
+			}
+		}
+	}
+	return cats
+}
+
+// listed returns whether the files of category cat are checked.
+func listed(cat string) bool {
+	switch cat {
+	case "unstaged", "submodules":
+		return *g_unstaged
+	case "uncommitted":
+		return *g_uncommitted
+	case "untracked":
+		return *g_untracked
+	case "unmerged":
+		return *g_unmerged
+	}
+	return false
+}
+
+// quotePath quotes path, like git does, if it has special characters.
+func quotePath(path string) string {
+	for _, r := range path {
+		if r == '"' || r == '\\' || !strconv.IsPrint(r) {
+			return strconv.Quote(path)
+		}
+	}
+	return path
+}
+
+// printList prints the offending files of cats, grouped by category.
+func printList(cats map[string][]statusEntry) {
+	for _, cat := range categories {
+		if !listed(cat) || len(cats[cat]) == 0 {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s:\n", cat)
+		for _, e := range cats[cat] {
+			if e.kind == kindRenameCopy {
+				fmt.Fprintf(os.Stderr, "\t%s %s -> %s\n", e.code(), quotePath(e.orig), quotePath(e.path))
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "\t%s %s\n", e.code(), quotePath(e.path))
+		}
+	}
+}
+
+// jsonFile is an offending file in the -format=json output.
+type jsonFile struct {
+	XY   string `json:"xy"`
+	Path string `json:"path"`
+	Orig string `json:"orig,omitempty"` // for renames and copies
+	Sub  string `json:"sub,omitempty"`  // for submodules: S<c><m><u>
+}
+
+// jsonCheck is the result of a check in the -format=json output.
+type jsonCheck struct {
+	Enabled bool       `json:"enabled"`
+	Clean   bool       `json:"clean"`
+	Files   []jsonFile `json:"files"`
+}
+
+// jsonReport is the -format=json output.
+type jsonReport struct {
+	Repo    string `json:"repo"`
+	Clean   bool   `json:"clean"`
+	Verdict string `json:"verdict"` // clean, warning or error
+	Checks  struct {
+		Unstaged    jsonCheck `json:"unstaged"`
+		Uncommitted jsonCheck `json:"uncommitted"`
+		Untracked   jsonCheck `json:"untracked"`
+		Unmerged    jsonCheck `json:"unmerged"`
+		Submodules  jsonCheck `json:"submodules"`
+	} `json:"checks"`
+}
+
+// printJSON prints the report on the offending files of cats as a JSON
+// document, and returns whether the working tree is clean.
+func printJSON(cats map[string][]statusEntry) (bool, error) {
+	top, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return false, err
+	}
+	report := jsonReport{
+		Repo:    strings.TrimSpace(string(top)),
+		Clean:   true,
+		Verdict: "clean",
+	}
+	for cat, check := range map[string]*jsonCheck{
+		"unstaged":    &report.Checks.Unstaged,
+		"uncommitted": &report.Checks.Uncommitted,
+		"untracked":   &report.Checks.Untracked,
+		"unmerged":    &report.Checks.Unmerged,
+		"submodules":  &report.Checks.Submodules,
+	} {
+		check.Enabled = listed(cat)
+		check.Clean = true
+		check.Files = []jsonFile{}
+		if !check.Enabled {
+			continue
+		}
+		for _, e := range cats[cat] {
+			check.Files = append(check.Files, jsonFile{XY: e.code(), Path: e.path, Orig: e.orig, Sub: e.sub.String()})
+		}
+		if len(check.Files) > 0 {
+			check.Clean = false
+			report.Clean = false
+		}
+	}
+	if !report.Clean {
+		report.Verdict = "error"
+		if *g_warn && !*g_exitcode {
+			report.Verdict = "warning"
+		}
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	_, err = fmt.Printf("%s\n", data)
+	return report.Clean, err
+}
+
 func main() {
 	flag.Parse()
 	var err error
@@ -44,126 +201,53 @@ func main() {
 		utils.HandleErr(err)
 	}
 
-	var git *exec.Cmd
+	args := []string{"status", "--porcelain=v2", "-z"}
 	if *g_ignoresub != "" {
-		git = exec.Command(
-			"git", "status", "--porcelain",
-			fmt.Sprintf("--ignore-submodules=%s", *g_ignoresub),
-		)
-	} else {
-		git = exec.Command("git", "status", "--porcelain")
+		args = append(args, fmt.Sprintf("--ignore-submodules=%s", *g_ignoresub))
 	}
-	bout, err := git.Output()
+	bout, err := exec.Command("git", args...).Output()
 	utils.HandleErr(err)
 
-	g_lines := utils.SplitLines(bout)
-	//status := string(bout)
-
-	if *g_unstaged {
-		var matched bool
-		for _, line := range g_lines {
-			// echo "$status" | grep -E '^[ MARC][MD]' -q
-			var i bool
-			i, err = regexp.MatchString("^( |M|A|R|C)(M|D)", line)
-			utils.HandleErr(err)
-			if !i && line != "" {
-				matched = true
-				break
-			}
-		}
-
-		if matched {
-			if *g_exitcode {
-				os.Exit(1)
-			}
-			output("There are unstaged changes. Use \"git add <file>\" to add.\n")
-		}
+	entries, err := parseStatus(bout)
+	utils.HandleErr(err)
+	cats := categorize(entries)
 
-		if *g_ignoresub != "" {
-			// git ls-files --error-unmatch --stage | grep -E '^160000' | sed -e 's/^.* //' | tr '\n' ' '
-			bout, err = exec.Command(
-				"git", "ls-files", "--error-unmatch", "--stage",
-			).Output()
-			utils.HandleErr(err)
-			lines := utils.SplitLines(bout)
-			matched := false
-			subm := []string{}
-			for _, line := range lines {
-				var i bool
-				i, err = regexp.MatchString("^160000", line)
-				utils.HandleErr(err)
-				if !i {
-					matched = true
-					subm = append(subm, line)
-				}
-			}
-			if matched {
-				cmdargs := []string{"status", "--porcelain", "--"}
-				cmdargs = append(cmdargs, subm...)
-				bout, err = exec.Command(
-					"git", cmdargs...,
-				).Output()
-				utils.HandleErr(err)
-				lines = utils.SplitLines(bout)
-				matched = false
-				for _, line := range lines {
-					var i bool
-					i, err = regexp.MatchString("^( |M|A|R|C)(M|D)", line)
-					if !i {
-						matched = true
-						output("There is modified content in submodules.\n")
-						break
-					}
-				}
-			}
+	switch *g_format {
+	case "text":
+		// below
+	case "json":
+		clean, err := printJSON(cats)
+		utils.HandleErr(err)
+		// as with text: -exit-code wins over -warn
+		if !clean && (*g_exitcode || !*g_warn) {
+			os.Exit(1)
 		}
+		return
+	default:
+		err = fmt.Errorf("unknown format [%s] (expected text or json)", *g_format)
+		utils.HandleErr(err)
 	}
 
-	testfct := func(lines []string, pattern, message string) {
-		var matched bool
-		for _, line := range lines {
-			var i bool
-			i, err = regexp.MatchString(pattern, line)
-			utils.HandleErr(err)
-			if !i && line != "" {
-				matched = true
-				break
-			}
+	check := func(cat, message string) {
+		if !listed(cat) || len(cats[cat]) == 0 {
+			return
 		}
-
-		if matched {
-			if *g_exitcode {
-				os.Exit(1)
-			}
-			output(message)
+		if *g_exitcode {
+			os.Exit(1)
 		}
+		output(message)
 	}
 
-	if *g_unmerged {
-		testfct(
-			g_lines,
-			"^(DD|AU|UD|UA|DU|AU|UU)",
-			"There are unmerged files. Use \"git add <file>\" when merged.\n",
-		)
-	}
-
-	if *g_uncommitted {
-		testfct(
-			g_lines,
-			"^(M|A|D|R|C)",
-			"There are uncommitted files. Use \"git commit\" to commit.\n",
-		)
-	}
-
-	if *g_untracked {
-		testfct(
-			g_lines,
-			"^?.*",
-			"There are untracked files not in .gitignore. Try \"make clean\" to remove temporary files.\n",
-		)
-	}
+	check("unstaged", "There are unstaged changes. Use \"git add <file>\" to add.\n")
+	check("submodules", "There is modified content in submodules.\n")
+	check("unmerged", "There are unmerged files. Use \"git add <file>\" when merged.\n")
+	check("uncommitted", "There are uncommitted files. Use \"git commit\" to commit.\n")
+	check("untracked", "There are untracked files not in .gitignore. Try \"make clean\" to remove temporary files.\n")
 
 	if g_output {
+		if *g_list {
+			printList(cats)
+		}
 		if *g_warn {
 			fmt.Fprintf(os.Stderr, "Warning in %s\n", pwd)
 			os.Exit(0)
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	//"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	//"github.com/mana-fwk/git-tools/utils"
@@ -166,4 +169,308 @@ func TestGitRepo(t *testing.T) {
 
 }
 
+func TestList(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "repo")
+
+	// a modified file, a staged one and an untracked one
+	for fname, content := range map[string]string{
+		"file.txt":        "modified\n",
+		"staged file.txt": "staged\n",
+		"untracked.txt":   "untracked\n",
+	} {
+		err = ioutil.WriteFile(filepath.Join(gitroot, fname), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command("git", "add", "staged file.txt")
+	cmd.Dir = gitroot
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd = exec.Command("git", "check-clean", "-warn", "-list")
+	cmd.Dir = gitroot
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		t.Fatalf("error: %v\n%v", err, stderr.String())
+	}
+	for _, expected := range []string{
+		"unstaged:\n\t M file.txt\n",
+		"uncommitted:\n\tA  staged file.txt\n",
+		"untracked:\n\t?? untracked.txt\n",
+	} {
+		if !strings.Contains(stderr.String(), expected) {
+			t.Errorf("output does not contain %q:\n%v", expected, stderr.String())
+		}
+	}
+	if strings.Contains(stderr.String(), "unmerged:") {
+		t.Errorf("no file should be listed as unmerged:\n%v", stderr.String())
+	}
+}
+
+func TestJSON(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "repo")
+
+	type report struct {
+		Repo    string
+		Clean   bool
+		Verdict string
+		Checks  map[string]struct {
+			Enabled bool
+			Clean   bool
+			Files   []struct{ XY, Path string }
+		}
+	}
+	check := func(args ...string) (report, error) {
+		cmd := exec.Command("git", append([]string{"check-clean", "-format=json"}, args...)...)
+		cmd.Dir = gitroot
+		bout, err := cmd.Output()
+		var r report
+		if jerr := json.Unmarshal(bout, &r); jerr != nil {
+			t.Fatalf("invalid JSON output: %v\n%s", jerr, string(bout))
+		}
+		return r, err
+	}
+
+	r, err := check()
+	if err != nil {
+		t.Fatalf("clean repository: %v", err)
+	}
+	if !r.Clean || r.Verdict != "clean" || len(r.Checks) != 5 || !r.Checks["unstaged"].Enabled {
+		t.Errorf("unexpected report for a clean repository: %+v", r)
+	}
+	if filepath.Base(r.Repo) != "repo" {
+		t.Errorf("unexpected repo path [%s]", r.Repo)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(gitroot, "untracked.txt"), []byte("untracked\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = check()
+	if err == nil {
+		t.Errorf("non-clean repository should exit with an error")
+	}
+	untracked := r.Checks["untracked"]
+	if r.Clean || r.Verdict != "error" || untracked.Clean ||
+		len(untracked.Files) != 1 || untracked.Files[0].XY != "??" || untracked.Files[0].Path != "untracked.txt" {
+		t.Errorf("unexpected report for an untracked file: %+v", r)
+	}
+	if !r.Checks["unstaged"].Clean {
+		t.Errorf("untracked file reported as unstaged: %+v", r)
+	}
+
+	r, err = check("-warn")
+	if err != nil || r.Verdict != "warning" {
+		t.Errorf("-warn: unexpected verdict [%s] (err=%v)", r.Verdict, err)
+	}
+
+	r, err = check("-untracked=false")
+	if err != nil || !r.Clean || r.Checks["untracked"].Enabled {
+		t.Errorf("-untracked=false: unexpected report %+v (err=%v)", r, err)
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	data := "1 .M N... 100644 100644 100644 1111111 1111111 a file.txt\x00" +
+		"2 R. N... 100644 100644 100644 2222222 2222222 R100 new \"name\"\x00old\nname\x00" +
+		"u UU N... 100644 100644 100644 100644 3333333 4444444 5555555 conflict.txt\x00" +
+		"1 .M SC.U 160000 160000 160000 6666666 6666666 sub\x00" +
+		"1 .M SC.. 160000 160000 160000 7777777 7777777 moved on\x00" +
+		"? untracked file\x00" +
+		"! ignored.o\x00"
+	entries, err := parseStatus([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []statusEntry{
+		{kind: kindOrdinary, xy: ".M", path: "a file.txt"},
+		{kind: kindRenameCopy, xy: "R.", score: "R100", path: `new "name"`, orig: "old\nname"},
+		{kind: kindUnmerged, xy: "UU", path: "conflict.txt"},
+		{kind: kindOrdinary, xy: ".M", sub: subState{submodule: true, commit: true, untracked: true}, path: "sub"},
+		{kind: kindOrdinary, xy: ".M", sub: subState{submodule: true, commit: true}, path: "moved on"},
+		{kind: kindUntracked, xy: "??", path: "untracked file"},
+		{kind: kindIgnored, xy: "!!", path: "ignored.o"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %d: %+v", len(expected), len(entries), entries)
+	}
+	for i, e := range entries {
+		if e != expected[i] {
+			t.Errorf("entry #%d: expected %+v, got %+v", i, expected[i], e)
+		}
+	}
+
+	cats := categorize(entries)
+	for cat, n := range map[string]int{
+		"unstaged": 2, "uncommitted": 1, "untracked": 1, "unmerged": 1, "submodules": 1,
+	} {
+		if len(cats[cat]) != n {
+			t.Errorf("expected %d %s entries, got %+v", n, cat, cats[cat])
+		}
+	}
+
+	for _, bad := range []string{"1 .M N...\x00", "2 R. N... 100644 100644 100644 1 1 R100 new", "x foo\x00"} {
+		_, err = parseStatus([]byte(bad))
+		if err == nil {
+			t.Errorf("expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestTrickyPaths(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "repo")
+
+	// a rename to a path with a space and quotes, and an untracked file
+	// whose name has a newline
+	cmd := exec.Command("git", "mv", "file.txt", `renamed "file".txt`)
+	cmd.Dir = gitroot
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(gitroot, "new\nline.txt"), []byte("untracked\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd = exec.Command("git", "check-clean", "-warn", "-list")
+	cmd.Dir = gitroot
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		t.Fatalf("error: %v\n%v", err, stderr.String())
+	}
+	for _, expected := range []string{
+		"There are uncommitted files.",
+		"There are untracked files not in .gitignore.",
+		"uncommitted:\n\tR  file.txt -> \"renamed \\\"file\\\".txt\"\n",
+		"untracked:\n\t?? \"new\\nline.txt\"\n",
+	} {
+		if !strings.Contains(stderr.String(), expected) {
+			t.Errorf("output does not contain %q:\n%v", expected, stderr.String())
+		}
+	}
+	if strings.Contains(stderr.String(), "unstaged") {
+		t.Errorf("no file should be listed as unstaged:\n%v", stderr.String())
+	}
+
+	cmd = exec.Command("git", "check-clean", "-format=json", "-warn")
+	cmd.Dir = gitroot
+	bout, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r struct {
+		Checks map[string]struct {
+			Files []struct{ XY, Path, Orig string }
+		}
+	}
+	err = json.Unmarshal(bout, &r)
+	if err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, string(bout))
+	}
+	files := r.Checks["uncommitted"].Files
+	if len(files) != 1 || files[0].XY != "R " || files[0].Path != `renamed "file".txt` || files[0].Orig != "file.txt" {
+		t.Errorf("unexpected uncommitted files: %+v", files)
+	}
+	files = r.Checks["untracked"].Files
+	if len(files) != 1 || files[0].Path != "new\nline.txt" {
+		t.Errorf("unexpected untracked files: %+v", files)
+	}
+}
+
+func TestSubmoduleState(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "repo")
+	subdir := filepath.Join(gitroot, "sub")
+
+	git := func(dir string, args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		bout, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%v", args, err, string(bout))
+		}
+	}
+	git(g_gitroot, "clone", "-q", gitroot, "sub-repo")
+	git(gitroot, "-c", "protocol.file.allow=always", "submodule", "add", "-q", filepath.Join(g_gitroot, "sub-repo"), "sub")
+	git(gitroot, "commit", "-m", "adding sub")
+
+	check := func(sub, unexpected string, expected ...string) {
+		cmd := exec.Command("git", "check-clean", "-warn", "-list")
+		cmd.Dir = gitroot
+		bout, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("error: %v\n%v", err, string(bout))
+		}
+		for _, e := range expected {
+			if !strings.Contains(string(bout), e) {
+				t.Errorf("output does not contain %q:\n%v", e, string(bout))
+			}
+		}
+		if strings.Contains(string(bout), unexpected) {
+			t.Errorf("output contains %q:\n%v", unexpected, string(bout))
+		}
+
+		cmd = exec.Command("git", "check-clean", "-warn", "-format=json")
+		cmd.Dir = gitroot
+		bout, err = cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(bout), `"sub": "`+sub+`"`) {
+			t.Errorf("no submodule state [%s] in:\n%v", sub, string(bout))
+		}
+	}
+
+	// only another commit checked out: the gitlink is to be added
+	git(subdir, "commit", "-q", "--allow-empty", "-m", "new commit")
+	check("SC..", "submodules:",
+		"There are unstaged changes.",
+		"unstaged:\n\t M sub\n",
+	)
+
+	// changes in the working tree of the submodule
+	git(gitroot, "add", "sub")
+	git(gitroot, "commit", "-q", "-m", "updated sub")
+	err = ioutil.WriteFile(filepath.Join(subdir, "file.txt"), []byte("modified\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("S.M.", "unstaged:",
+		"There is modified content in submodules.",
+		"submodules:\n\t M sub\n",
+	)
+}
+
 // EOF
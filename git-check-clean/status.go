@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// entryKind is the kind of an entry of 'git status --porcelain=v2'.
+type entryKind int
+
+const (
+	kindOrdinary   entryKind = iota // 1: changed tracked file
+	kindRenameCopy                  // 2: renamed or copied file
+	kindUnmerged                    // u: unmerged file
+	kindUntracked                   // ?: untracked file
+	kindIgnored                     // !: ignored file
+)
+
+// subState is the submodule state field of an entry: "N..." for a file,
+// or "S<c><m><u>" for a submodule.
+type subState struct {
+	submodule bool
+	commit    bool // the commit changed
+	modified  bool // it has tracked changes
+	untracked bool // it has untracked files
+}
+
+// statusEntry is an entry of 'git status --porcelain=v2'.
+type statusEntry struct {
+	kind  entryKind
+	xy    string // status code, '.' for unmodified, see git-status(1)
+	sub   subState
+	score string // for renames and copies: R<score> or C<score>
+	path  string // relative to the top of the working tree
+	orig  string // for renames and copies: the path in HEAD
+}
+
+// code returns the status code of e as with 'git status --porcelain', with
+// a space for unmodified.
+func (e statusEntry) code() string {
+	switch e.kind {
+	case kindUntracked:
+		return "??"
+	case kindIgnored:
+		return "!!"
+	}
+	return strings.Replace(e.xy, ".", " ", -1)
+}
+
+// String returns the submodule state field of a submodule, and an empty
+// string for a file.
+func (s subState) String() string {
+	if !s.submodule {
+		return ""
+	}
+	flag := func(set bool, c byte) byte {
+		if set {
+			return c
+		}
+		return '.'
+	}
+	return string([]byte{'S', flag(s.commit, 'C'), flag(s.modified, 'M'), flag(s.untracked, 'U')})
+}
+
+// parseSubState parses the submodule state field of an entry.
+func parseSubState(field string) (subState, error) {
+	if len(field) != 4 || (field[0] != 'N' && field[0] != 'S') {
+		return subState{}, fmt.Errorf("invalid submodule state [%s]", field)
+	}
+	if field[0] == 'N' {
+		return subState{}, nil
+	}
+	return subState{
+		submodule: true,
+		commit:    field[1] == 'C',
+		modified:  field[2] == 'M',
+		untracked: field[3] == 'U',
+	}, nil
+}
+
+// parseStatus parses the output of 'git status --porcelain=v2 -z'.
+func parseStatus(data []byte) ([]statusEntry, error) {
+	entries := []statusEntry{}
+	records := bytes.Split(data, []byte{0})
+	for i := 0; i < len(records); i++ {
+		record := string(records[i])
+		if record == "" {
+			continue
+		}
+
+		var e statusEntry
+		var fields []string
+		switch record[0] {
+		case '1':
+			// 1 <XY> <sub> <mH> <mI> <mW> <hH> <hI> <path>
+			e.kind = kindOrdinary
+			fields = strings.SplitN(record, " ", 9)
+		case '2':
+			// 2 <XY> <sub> <mH> <mI> <mW> <hH> <hI> <X><score> <path> NUL <origPath>
+			e.kind = kindRenameCopy
+			fields = strings.SplitN(record, " ", 10)
+		case 'u':
+			// u <XY> <sub> <m1> <m2> <m3> <mW> <h1> <h2> <h3> <path>
+			e.kind = kindUnmerged
+			fields = strings.SplitN(record, " ", 11)
+		case '?', '!':
+			// ? <path> or ! <path>
+			if len(record) < 3 || record[1] != ' ' {
+				return nil, fmt.Errorf("invalid status entry [%s]", record)
+			}
+			e.kind = kindUntracked
+			e.xy = "??"
+			if record[0] == '!' {
+				e.kind = kindIgnored
+				e.xy = "!!"
+			}
+			e.path = record[2:]
+			entries = append(entries, e)
+			continue
+		case '#':
+			// header, with --branch
+			continue
+		default:
+			return nil, fmt.Errorf("invalid status entry [%s]", record)
+		}
+
+		n := map[entryKind]int{kindOrdinary: 9, kindRenameCopy: 10, kindUnmerged: 11}[e.kind]
+		if len(fields) != n || len(fields[1]) != 2 {
+			return nil, fmt.Errorf("invalid status entry [%s]", record)
+		}
+		e.xy = fields[1]
+		sub, err := parseSubState(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		e.sub = sub
+		e.path = fields[n-1]
+		if e.kind == kindRenameCopy {
+			e.score = fields[8]
+			i++
+			if i >= len(records) {
+				return nil, fmt.Errorf("missing original path of [%s]", e.path)
+			}
+			e.orig = string(records[i])
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// EOF
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mana-fwk/git-tools/utils"
+)
+
+// backupInfoName is the name of the file describing a backup, in the
+// backup directory of a removed submodule.
+const backupInfoName = "backup.json"
+
+// configEntry is a key/value pair of a git configuration file.
+type configEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// backupInfo describes a removed submodule, saved along with its working
+// tree and git directory so that it can be brought back with -restore.
+type backupInfo struct {
+	Path       string           `json:"path"`
+	Name       string           `json:"name"`
+	URL        string           `json:"url"`
+	SHA        string           `json:"sha"`
+	GitDir     string           `json:"gitdir,omitempty"` // relative to the git dir of the superproject
+	Gitmodules []configEntry    `json:"gitmodules"`
+	Config     []configEntry    `json:"config"`
+	Worktrees  []worktreeBackup `json:"worktrees,omitempty"`
+	Date       time.Time        `json:"date"`
+}
+
+// worktreeBackup describes what was removed of a submodule in a working
+// tree of the superproject, besides the checkout: its stale git directory,
+// saved as worktrees/<i> in the backup directory, and the section of its
+// per-worktree configuration.
+type worktreeBackup struct {
+	Dir    string        `json:"dir"`              // top directory of the working tree
+	GitDir string        `json:"gitdir,omitempty"` // absolute
+	Config []configEntry `json:"config,omitempty"` // from config.worktree
+}
+
+// backup is the backup of a removed submodule.
+type backup struct {
+	dir  string // holds backup.json, worktree/, gitdir/ and worktrees/
+	info backupInfo
+}
+
+// worktreeDir returns where the git directory of the i-th entry of
+// b.info.Worktrees is saved.
+func (b *backup) worktreeDir(i int) string {
+	return filepath.Join(b.dir, "worktrees", fmt.Sprintf("%d", i))
+}
+
+// backupRoot returns the directory holding the backups of the submodules
+// removed from the repository whose git directory is gitdir.
+func backupRoot(gitdir string) (string, error) {
+	if *g_backup == "" {
+		return filepath.Join(gitdir, "rm-submodule-backup"), nil
+	}
+	return filepath.Abs(*g_backup)
+}
+
+// gitConfigRegexp returns the entries of a git configuration file (the
+// repository one if file is empty) whose keys match re.
+func gitConfigRegexp(file, re string) ([]configEntry, error) {
+	args := []string{"config", "-z"}
+	if file != "" {
+		args = append(args, "-f", file)
+	} else {
+		args = append(args, "--local")
+	}
+	args = append(args, "--get-regexp", re)
+	bout, err := exec.Command("git", args...).Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 1 {
+			// no match
+			return nil, nil
+		}
+		return nil, err
+	}
+	entries := []configEntry{}
+	// <key> LF <value> NUL, or <key> NUL for keys without value
+	for _, kv := range strings.Split(string(bout), "\x00") {
+		if kv == "" {
+			continue
+		}
+		e := configEntry{Key: kv}
+		if i := strings.Index(kv, "\n"); i >= 0 {
+			e.Key, e.Value = kv[:i], kv[i+1:]
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// configSection returns the entries of section submodule.<name> of a git
+// configuration file (the repository one if file is empty).
+func configSection(file, name string) ([]configEntry, error) {
+	return gitConfigRegexp(file, `^submodule\.`+regexp.QuoteMeta(name)+`\.`)
+}
+
+// newBackup returns the backup of sub, to be stored in a new directory
+// under root. gitdir is the git directory of the superproject and moddir,
+// if not empty, the git directory of the submodule.
+func newBackup(root, gitdir, moddir string, sub submodule) (*backup, error) {
+	b := &backup{info: backupInfo{
+		Path: sub.path,
+		Name: sub.name,
+		URL:  sub.url,
+		SHA:  sub.sha,
+		Date: time.Now().UTC().Truncate(time.Second),
+	}}
+	if moddir != "" {
+		rel, err := filepath.Rel(gitdir, moddir)
+		if err != nil {
+			return nil, err
+		}
+		b.info.GitDir = filepath.ToSlash(rel)
+	}
+
+	var err error
+	b.info.Gitmodules, err = configSection(".gitmodules", sub.name)
+	if err != nil {
+		return nil, err
+	}
+	b.info.Config, err = configSection("", sub.name)
+	if err != nil {
+		return nil, err
+	}
+
+	// <date>-<name>, made unique
+	base := b.info.Date.Format("20060102-150405") + "-" + strings.Replace(sub.name, "/", "_", -1)
+	b.dir = filepath.Join(root, base)
+	for i := 2; utils.PathExists(b.dir); i++ {
+		b.dir = filepath.Join(root, fmt.Sprintf("%s-%d", base, i))
+	}
+	return b, nil
+}
+
+// saveAction returns an action creating the directory of backup b and
+// writing its description.
+func (b *backup) saveAction() action {
+	fname := filepath.Join(b.dir, backupInfoName)
+	return action{
+		desc: "write " + fname,
+		run: func() error {
+			data, err := json.MarshalIndent(b.info, "", "  ")
+			if err != nil {
+				return err
+			}
+			err = os.MkdirAll(filepath.Dir(b.dir), 0700)
+			if err != nil {
+				return err
+			}
+			err = os.Mkdir(b.dir, 0700)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(fname, append(data, '\n'), 0644)
+		},
+		undo: func() error {
+			err := os.Remove(fname)
+			if err != nil {
+				return err
+			}
+			// only empty once everything moved there was moved back
+			return os.Remove(b.dir)
+		},
+	}
+}
+
+// readBackup reads the backup in directory dir.
+func readBackup(dir string) (*backup, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, backupInfoName))
+	if err != nil {
+		return nil, err
+	}
+	b := &backup{dir: dir}
+	err = json.Unmarshal(data, &b.info)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup [%s]: %v", dir, err)
+	}
+	return b, nil
+}
+
+// findBackup returns the backup designated by arg: either the absolute path
+// of a backup directory, or the path (relative to prefix) or name of a
+// removed submodule, whose most recent backup under root is then returned.
+func findBackup(root, arg, prefix string) (*backup, error) {
+	if filepath.IsAbs(arg) && utils.PathExists(filepath.Join(arg, backupInfoName)) {
+		return readBackup(arg)
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(root, "*", backupInfoName))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+
+	p := path.Join(prefix, filepath.ToSlash(arg))
+	var found *backup
+	for _, fname := range dirs {
+		b, err := readBackup(filepath.Dir(fname))
+		if err != nil {
+			return nil, err
+		}
+		if b.info.Path != p && b.info.Name != arg {
+			continue
+		}
+		if found == nil || !b.info.Date.Before(found.info.Date) {
+			found = b
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no backup of submodule [%s] in [%s]", arg, root)
+	}
+	return found, nil
+}
+
+// submodule returns the submodule saved in backup b.
+func (b *backup) submodule() submodule {
+	return submodule{
+		path: b.info.Path,
+		name: b.info.Name,
+		url:  b.info.URL,
+		sha:  b.info.SHA,
+	}
+}
+
+// restorePlan returns the actions bringing back the submodules saved in
+// backups into the repository at top (the current directory), whose git
+// directory is gitdir. Unless -no-commit is given, the restoration is
+// committed with message msg, and the new gitlink then committed in supers.
+func restorePlan(top, gitdir string, backups []*backup, msg string, supers []superproject) ([]action, error) {
+	config, err := gitPath("", "config")
+	if err != nil {
+		return nil, err
+	}
+	index, err := gitPath("", "index")
+	if err != nil {
+		return nil, err
+	}
+	gitmodules := filepath.Join(top, ".gitmodules")
+
+	plan := []action{}
+	for _, b := range backups {
+		if b.info.GitDir != "" {
+			plan = append(plan, moveAction(
+				filepath.Join(b.dir, "gitdir"),
+				filepath.Join(gitdir, filepath.FromSlash(b.info.GitDir)),
+			))
+		}
+		plan = append(plan, moveAction(
+			filepath.Join(b.dir, "worktree"),
+			filepath.Join(top, filepath.FromSlash(b.info.Path)),
+		))
+		for _, e := range b.info.Gitmodules {
+			plan = append(plan, snapshot(
+				gitAction("config", "-f", ".gitmodules", "--add", e.Key, e.Value),
+				gitmodules,
+			))
+		}
+		for _, e := range b.info.Config {
+			plan = append(plan, snapshot(
+				gitAction("config", "--add", e.Key, e.Value),
+				config,
+			))
+		}
+		for i, wb := range b.info.Worktrees {
+			if wb.GitDir != "" {
+				plan = append(plan, moveAction(b.worktreeDir(i), wb.GitDir))
+			}
+			if len(wb.Config) == 0 {
+				continue
+			}
+			wconfig, err := gitPath(wb.Dir, "config.worktree")
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range wb.Config {
+				plan = append(plan, snapshot(
+					gitAction("config", "-f", wconfig, "--add", e.Key, e.Value),
+					wconfig,
+				))
+			}
+		}
+		plan = append(plan,
+			snapshot(gitAction("add", ".gitmodules"), index),
+			snapshot(gitAction(
+				"update-index", "--add", "--cacheinfo",
+				fmt.Sprintf("160000,%s,%s", b.info.SHA, b.info.Path),
+			), index),
+		)
+	}
+
+	commits, err := commitPlan(msg, supers)
+	if err != nil {
+		return nil, err
+	}
+	return append(plan, commits...), nil
+}
+
+// restore brings back the submodules designated by args (see findBackup)
+// into the repository at top, whose git directory is gitdir.
+func restore(top, gitdir, prefix string, args []string) error {
+	root, err := backupRoot(gitdir)
+	if err != nil {
+		return err
+	}
+
+	backups := []*backup{}
+	subs := []submodule{}
+	for _, arg := range args {
+		b, err := findBackup(root, arg, prefix)
+		if err != nil {
+			return err
+		}
+		sub := b.submodule()
+
+		// the submodule must not have been replaced in the meantime
+		if utils.PathExists(filepath.Join(top, filepath.FromSlash(sub.path))) {
+			return fmt.Errorf("can not restore submodule [%s]: path already exists", sub.path)
+		}
+		entries, err := configSection(".gitmodules", sub.name)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return fmt.Errorf("can not restore submodule [%s]: .gitmodules already has a [submodule %q] section", sub.path, sub.name)
+		}
+		if b.info.GitDir != "" && utils.PathExists(filepath.Join(gitdir, filepath.FromSlash(b.info.GitDir))) {
+			return fmt.Errorf("can not restore submodule [%s]: [%s] already exists", sub.path, b.info.GitDir)
+		}
+		for _, wb := range b.info.Worktrees {
+			if !utils.PathExists(wb.Dir) {
+				return fmt.Errorf("can not restore submodule [%s]: worktree [%s] no longer exists", sub.path, wb.Dir)
+			}
+			if wb.GitDir != "" && utils.PathExists(wb.GitDir) {
+				return fmt.Errorf("can not restore submodule [%s]: [%s] already exists", sub.path, wb.GitDir)
+			}
+		}
+
+		backups = append(backups, b)
+		subs = append(subs, sub)
+	}
+
+	supers := []superproject{}
+	if *g_recursive {
+		supers, err = superprojects(top)
+		if err != nil {
+			return err
+		}
+	}
+
+	msg, err := message("restored", subs, false)
+	if err != nil {
+		return err
+	}
+	plan, err := restorePlan(top, gitdir, backups, msg, supers)
+	if err != nil {
+		return err
+	}
+
+	if *g_dry_run {
+		for _, b := range backups {
+			fmt.Printf("would restore submodule [%s] (url=%s) from [%s]\n", b.info.Path, b.info.URL, b.dir)
+		}
+		printPlan(top, plan, msg)
+		return nil
+	}
+
+	err = runPlan(plan)
+	if err != nil {
+		return err
+	}
+
+	// the backups are now empty: only then are they forgotten
+	for _, b := range backups {
+		// the parent of the git dirs moved back to the worktrees, if any
+		os.Remove(filepath.Join(b.dir, "worktrees"))
+		fis, err := ioutil.ReadDir(b.dir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			if fi.Name() != backupInfoName {
+				return fmt.Errorf("backup [%s] was not emptied: [%s] is left", b.dir, fi.Name())
+			}
+		}
+		err = os.Remove(filepath.Join(b.dir, backupInfoName))
+		if err == nil {
+			err = os.Remove(b.dir)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EOF
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mana-fwk/git-tools/utils"
+)
+
+// gitOutput runs git with args in directory dir and returns its trimmed
+// output.
+func gitOutput(dir string, args ...string) (string, error) {
+	git := exec.Command("git", args...)
+	git.Dir = dir
+	bout, err := git.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s in [%s]: %v", strings.Join(args, " "), dir, err)
+	}
+	return strings.Trim(string(bout), " \r\n"), nil
+}
+
+// isTerminal returns whether f is a terminal someone may answer from.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	// /dev/null is a character device too, but nobody answers from it
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(fi, null)
+}
+
+// dirSize returns the total size of the files under dir.
+func dirSize(dir string) (int64, error) {
+	size := int64(0)
+	err := filepath.Walk(dir, func(fname string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// humanSize formats a size in bytes for humans.
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// summary describes what goes away with sub, checked out in directory dir
+// (relative to the current one) and whose git directory is moddir (if
+// not empty) or, outside of the superproject and kept, external.
+func summary(sub submodule, dir, moddir, external string) (string, error) {
+	lines := []string{
+		fmt.Sprintf("submodule [%s]", sub.path),
+		fmt.Sprintf("  url:              %s", sub.url),
+	}
+
+	if !utils.PathExists(filepath.Join(dir, ".git")) {
+		lines = append(lines, fmt.Sprintf("  commit:           not checked out (recorded: %s)", sub.sha))
+	} else {
+		head, err := gitOutput(dir, "rev-parse", "HEAD")
+		if err != nil {
+			return "", err
+		}
+		commit := fmt.Sprintf("  commit:           %s", head)
+		if head != sub.sha {
+			commit += fmt.Sprintf(" (recorded: %s)", sub.sha)
+		}
+		lines = append(lines, commit)
+
+		stashes, err := gitOutput(dir, "stash", "list")
+		if err != nil {
+			return "", err
+		}
+		n := 0
+		if stashes != "" {
+			n = len(strings.Split(stashes, "\n"))
+		}
+		lines = append(lines, fmt.Sprintf("  stashes:          %d", n))
+
+		// branches without upstream, and commits on no remote
+		refs, err := gitOutput(dir, "for-each-ref", "--format=%(refname:short) %(upstream)", "refs/heads")
+		if err != nil {
+			return "", err
+		}
+		local := []string{}
+		for _, ref := range strings.Split(refs, "\n") {
+			fields := strings.Fields(ref)
+			if len(fields) == 1 {
+				local = append(local, fields[0])
+			}
+		}
+		if len(local) == 0 {
+			local = append(local, "none")
+		}
+		lines = append(lines, fmt.Sprintf("  local branches:   %s", strings.Join(local, ", ")))
+
+		unpushed, err := gitOutput(dir, "rev-list", "--count", "HEAD", "--branches", "--not", "--remotes")
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, fmt.Sprintf("  unpushed commits: %s", unpushed))
+	}
+
+	if moddir != "" {
+		size, err := dirSize(moddir)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, fmt.Sprintf("  git dir:          %s (%s)", moddir, humanSize(size)))
+	}
+	if external != "" {
+		lines = append(lines, fmt.Sprintf("  git dir:          %s (kept)", external))
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// confirm prints to w the summary of the removal of subs from the
+// superproject whose git directory is gitdir, and asks on r whether to
+// proceed.
+func confirm(r io.Reader, w io.Writer, subs []submodule, gitdir string) (bool, error) {
+	for _, sub := range subs {
+		moddir, external, err := moduleDir(gitdir, sub.path, sub)
+		if err != nil {
+			return false, err
+		}
+		s, err := summary(sub, sub.path, moddir, external)
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprint(w, s)
+	}
+
+	what := "submodule"
+	if len(subs) > 1 {
+		what = fmt.Sprintf("%d submodules", len(subs))
+	}
+	fmt.Fprintf(w, "remove %s? [y/N] ", what)
+	answer, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+
+// EOF
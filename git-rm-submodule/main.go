@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -12,10 +14,30 @@ import (
 )
 
 var (
-	g_no_commit = flag.Bool("no-commit", false, "do not commit the result")
-	g_verbose   = flag.Bool("verbose", false, "")
+	g_no_commit        = flag.Bool("no-commit", false, "do not commit the result")
+	g_recursive        = flag.Bool("recursive-commit", false, "also commit the updated gitlink in all the enclosing superprojects")
+	g_dry_run          = flag.Bool("dry-run", false, "run all the checks and print what would be done, without doing it")
+	g_backup           = flag.String("backup", "", "directory where the removed submodules are moved (default: <gitdir>/rm-submodule-backup)")
+	g_keep_worktree    = flag.Bool("keep-worktree", false, "keep the checked out files of the submodules, as plain tracked files")
+	g_restore          = flag.Bool("restore", false, "bring back removed submodules (paths, names or backup directories) from their backup")
+	g_message          = flag.String("message", "", "use the given commit message")
+	g_message_template = flag.String("message-template", "", "make the commit message from the given text/template, executed with .Action, .Path, .Name, .URL, .SHA and .Submodules")
+	g_signoff          = flag.Bool("signoff", false, "add a Signed-off-by trailer to the commit message")
+	g_gpg_sign         = &optionalString{}
+	g_yes              = flag.Bool("yes", false, "do not ask for confirmation")
+	g_verbose          = flag.Bool("verbose", false, "")
 )
 
+func init() {
+	flag.StringVar(g_message, "m", "", "shorthand for -message")
+	flag.Var(g_gpg_sign, "gpg-sign", "GPG-sign the commits (-gpg-sign=<keyid> to choose the key)")
+}
+
+// warnf reports something which does not prevent the removal.
+func warnf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "**warning**: "+format, args...)
+}
+
 func debug(cmd *exec.Cmd) {
 	if *g_verbose {
 		dir := cmd.Dir
@@ -29,56 +51,254 @@ func debug(cmd *exec.Cmd) {
 	}
 }
 
+// submodule is a submodule to remove.
+type submodule struct {
+	path string // path relative to the top of the superproject
+	name string // name of the submodule, from .gitmodules
+	url  string
+	sha  string // commit recorded in the superproject
+}
+
+// superproject is a repository enclosing another one as a submodule.
+type superproject struct {
+	top string // top directory of the superproject
+	sub string // path of the enclosed repository, relative to top
+}
+
+// superprojects returns the chain of superprojects enclosing the
+// repository at top, starting from the innermost one.
+func superprojects(top string) ([]superproject, error) {
+	supers := []superproject{}
+	for dir := top; ; {
+		git := exec.Command("git", "rev-parse", "--show-superproject-working-tree")
+		git.Dir = dir
+		bout, err := git.Output()
+		if err != nil {
+			return nil, err
+		}
+		parent := strings.Trim(string(bout), " \r\n")
+		if parent == "" {
+			return supers, nil
+		}
+		sub, err := filepath.Rel(parent, dir)
+		if err != nil {
+			return nil, err
+		}
+		supers = append(supers, superproject{top: parent, sub: filepath.ToSlash(sub)})
+		dir = parent
+	}
+}
+
+// listSubmodules returns the paths and recorded commits of all the
+// submodules of the repository in directory dir (the current one if
+// empty), from the 160000 entries of 'git ls-files --stage'.
+func listSubmodules(dir string) ([]submodule, error) {
+	git := exec.Command("git", "ls-files", "--stage", "--full-name", "-z")
+	git.Dir = dir
+	bout, err := git.Output()
+	if err != nil {
+		return nil, err
+	}
+	subs := []submodule{}
+	for _, line := range strings.Split(string(bout), "\x00") {
+		if !strings.HasPrefix(line, "160000 ") {
+			continue
+		}
+		// <mode> SP <object> SP <stage> TAB <file>
+		tab := strings.Index(line, "\t")
+		if tab < 0 {
+			continue
+		}
+		fields := strings.Fields(line[:tab])
+		if len(fields) != 3 {
+			continue
+		}
+		subs = append(subs, submodule{path: line[tab+1:], sha: fields[1]})
+	}
+	return subs, nil
+}
+
+// checkSubtree runs the safety checks in the submodule checked out in
+// directory dir and, recursively, in all its own submodules, so that no
+// work is lost with the whole subtree. Nested submodules are checked first,
+// so that a failure is reported where the work would be lost.
+func checkSubtree(dir string) error {
+	if !utils.PathExists(filepath.Join(dir, ".git")) {
+		// not checked out: nothing to lose
+		return nil
+	}
+
+	nested, err := listSubmodules(dir)
+	if err != nil {
+		return fmt.Errorf("could not list the submodules of [%s]: %v", dir, err)
+	}
+	for _, sub := range nested {
+		err = checkSubtree(path.Join(dir, sub.path))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, check := range []string{"check-clean", "check-unpushed", "check-non-tracking"} {
+		git := exec.Command("git", check)
+		git.Dir = dir
+		debug(git)
+		// report what the check found as being about the submodule
+		var out bytes.Buffer
+		git.Stdout = &out
+		git.Stderr = &out
+		err = git.Run()
+		if err != nil {
+			msg := fmt.Sprintf("submodule [%s] is not safe to remove (git %s: %v)", dir, check, err)
+			for _, line := range strings.Split(strings.TrimRight(out.String(), "\n"), "\n") {
+				if line != "" {
+					msg += "\n  " + line
+				}
+			}
+			return fmt.Errorf("%s", msg)
+		}
+	}
+	return nil
+}
+
+// submoduleNames returns the names of the submodules declared in the
+// .gitmodules file of the current directory, indexed by path.
+// A submodule name differs from its path after a 'git mv', or when it was
+// added with 'git submodule add --name'.
+func submoduleNames() (map[string]string, error) {
+	names := make(map[string]string)
+	if !utils.PathExists(".gitmodules") {
+		return names, nil
+	}
+	entries, err := gitConfigRegexp(".gitmodules", `^submodule\..*\.path$`)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := strings.TrimSuffix(strings.TrimPrefix(e.Key, "submodule."), ".path")
+		names[e.Value] = name
+	}
+	return names, nil
+}
+
+// findSubmodules resolves the paths, names and glob patterns given on the
+// command line into submodules. Paths are relative to prefix, the directory
+// the command was run from inside the superproject, and are tried first.
+func findSubmodules(args []string, prefix string) ([]submodule, error) {
+	all, err := listSubmodules("")
+	if err != nil {
+		return nil, err
+	}
+	names, err := submoduleNames()
+	if err != nil {
+		return nil, err
+	}
+
+	subs := []submodule{}
+	seen := make(map[string]bool)
+	add := func(sub submodule) {
+		if seen[sub.path] {
+			return
+		}
+		seen[sub.path] = true
+		name, ok := names[sub.path]
+		if !ok {
+			name = sub.path
+		}
+		sub.name = name
+		subs = append(subs, sub)
+	}
+
+	for _, arg := range args {
+		pattern := path.Join(prefix, filepath.ToSlash(arg))
+		matched := false
+		for _, sub := range all {
+			ok, err := path.Match(pattern, sub.path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern [%s]: %v", arg, err)
+			}
+			if ok {
+				matched = true
+				add(sub)
+			}
+		}
+		if matched {
+			continue
+		}
+
+		// not a path: try the submodule names
+		for _, sub := range all {
+			name, ok := names[sub.path]
+			if !ok {
+				continue
+			}
+			if ok, _ := path.Match(arg, name); ok {
+				matched = true
+				add(sub)
+			}
+		}
+		if !matched {
+			if !utils.PathExists(pattern) && !strings.ContainsAny(arg, `*?[`) {
+				return nil, fmt.Errorf("no such directory [%s]", arg)
+			}
+			return nil, fmt.Errorf("no such submodule [%s]", arg)
+		}
+	}
+	return subs, nil
+}
+
+// commitMessage returns the commit message for subs, removed (or restored,
+// vendored...) as told by verb. With sha, the recorded commits of the
+// submodules are given along with their URLs.
+func commitMessage(verb string, subs []submodule, sha bool) string {
+	origin := func(sub submodule) string {
+		if sha {
+			return fmt.Sprintf("url=%s, sha=%s", sub.url, sub.sha)
+		}
+		return fmt.Sprintf("url=%s", sub.url)
+	}
+	if len(subs) == 1 {
+		return fmt.Sprintf("%s submodule [%s] (%s)", verb, subs[0].path, origin(subs[0]))
+	}
+	paths := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		paths = append(paths, sub.path)
+	}
+	msg := fmt.Sprintf("%s submodules [%s]\n\n", verb, strings.Join(paths, ", "))
+	for _, sub := range subs {
+		msg += fmt.Sprintf("- %s (%s)\n", sub.path, origin(sub))
+	}
+	return msg
+}
+
 func main() {
 	flag.Parse()
 	var err error
 
-	dir := ""
-	switch flag.NArg() {
-	case 0:
-		err = fmt.Errorf("you need to give a submodule directory to remove")
-		utils.HandleErr(err)
-	case 1:
-		dir = flag.Args()[0]
-	default:
-		// TODO: allow to remove n submodules in one go...
+	if flag.NArg() == 0 {
 		err = fmt.Errorf("you need to give a submodule directory to remove")
 		utils.HandleErr(err)
 	}
 
-	// make sure we get the correct collation stuff
-	err = os.Setenv("LC_MESSAGES", "C")
-	utils.HandleErr(err)
-
-	// check 'dir' is a valid submodule
-	if !utils.PathExists(dir) {
-		err = fmt.Errorf("no such directory [%s]", dir)
+	if *g_recursive && *g_no_commit {
+		err = fmt.Errorf("-recursive-commit and -no-commit are mutually exclusive")
 		utils.HandleErr(err)
 	}
 
-	git := exec.Command(
-		"git", "ls-files",
-		"--error-unmatch", "--stage", "--", dir,
-	)
-	bout, err := git.Output()
-	utils.HandleErr(err)
-	out := strings.Trim(string(bout), " \r\n")
-	if out == "" {
-		err = fmt.Errorf("no such submodule [%s]", dir)
+	if *g_message != "" && *g_message_template != "" {
+		err = fmt.Errorf("-message and -message-template are mutually exclusive")
 		utils.HandleErr(err)
 	}
 
-	// get the full path of the submodule
-	git = exec.Command("git", "ls-files", "--full-name", dir)
-	bout, err = git.Output()
+	// make sure we get the correct collation stuff
+	err = os.Setenv("LC_MESSAGES", "C")
 	utils.HandleErr(err)
 
-	lines := utils.SplitLines(bout)
-	dir = strings.Trim(lines[0], " \r\n")
-
-	if *g_verbose {
-		fmt.Printf("found submodule [%s]\n", dir)
-	}
+	// find the submodules to remove, relative to the toplevel directory
+	git := exec.Command("git", "rev-parse", "--show-prefix")
+	bout, err := git.Output()
+	utils.HandleErr(err)
+	prefix := strings.Trim(string(bout), " \r\n")
 
 	// ensure we are in the toplevel directory
 	git = exec.Command("git", "rev-parse", "--show-toplevel")
@@ -92,6 +312,22 @@ func main() {
 	utils.HandleErr(err)
 	defer os.Chdir(pwd)
 
+	// -backup and the backup directories given to -restore are relative to
+	// the current directory
+	if *g_backup != "" {
+		*g_backup, err = filepath.Abs(*g_backup)
+		utils.HandleErr(err)
+	}
+	args := flag.Args()
+	if *g_restore {
+		for i, arg := range args {
+			if utils.PathExists(filepath.Join(arg, backupInfoName)) {
+				args[i], err = filepath.Abs(arg)
+				utils.HandleErr(err)
+			}
+		}
+	}
+
 	err = os.Chdir(top)
 	utils.HandleErr(err)
 
@@ -99,21 +335,6 @@ func main() {
 		fmt.Printf("root [%s]\n", top)
 	}
 
-	// check if submodule is clean
-	git = exec.Command("git", "check-clean")
-	debug(git)
-	utils.HandleErr(git.Run())
-
-	// check for unpushed changes
-	git = exec.Command("git", "check-unpushed")
-	debug(git)
-	utils.HandleErr(git.Run())
-
-	// check for local non-tracking-branches
-	git = exec.Command("git", "check-non-tracking")
-	debug(git)
-	utils.HandleErr(git.Run())
-
 	// find the real git-dir
 	git = exec.Command("git", "rev-parse", "--git-dir")
 	bout, err = git.Output()
@@ -127,67 +348,106 @@ func main() {
 		fmt.Printf("gitdir [%s]\n", gitdir)
 	}
 
-	// get submodule url
-	url := "unknown"
-	git = exec.Command(
-		"git", "config", "--get",
-		fmt.Sprintf("submodule.%s.url", dir),
-	)
-	bout, err = git.Output()
-	if err == nil {
-		url = strings.Trim(string(bout), " \r\n")
+	if *g_restore {
+		err = restore(top, gitdir, prefix, args)
+		utils.HandleErr(err)
+		return
 	}
 
-	// remove config entries
-	git = exec.Command(
-		"git", "config", "-f", ".gitmodules", "--remove-section",
-		fmt.Sprintf("submodule.%s", dir),
-	)
-	debug(git)
-	err = git.Run()
+	subs, err := findSubmodules(args, prefix)
 	utils.HandleErr(err)
 
-	git = exec.Command(
-		"git", "config", "--remove-section",
-		fmt.Sprintf("submodule.%s", dir),
-	)
-	debug(git)
-	err = git.Run()
-	utils.HandleErr(err)
+	if *g_verbose {
+		for _, sub := range subs {
+			fmt.Printf("found submodule [%s] (name=%s)\n", sub.path, sub.name)
+		}
+	}
 
-	git = exec.Command("git", "rm", "--cached", dir)
-	debug(git)
-	err = git.Run()
-	utils.HandleErr(err)
+	// validate everything before removing anything
 
-	err = os.RemoveAll(dir)
-	utils.HandleErr(err)
+	// check 'dir' is a valid submodule
+	for _, sub := range subs {
+		if !utils.PathExists(sub.path) {
+			err = fmt.Errorf("no such directory [%s]", sub.path)
+			utils.HandleErr(err)
+		}
+	}
 
-	// remove git dir as well.
-	if utils.PathExists(filepath.Join(gitdir, "modules", dir)) {
-		err = os.RemoveAll(filepath.Join(gitdir, "modules", dir))
+	// check the submodules and their nested submodules, that is where work
+	// would be lost: the superproject itself is left as is.
+	for _, sub := range subs {
+		err = checkSubtree(sub.path)
 		utils.HandleErr(err)
 	}
 
-	if *g_no_commit {
-		return
+	// the commit must only contain the removal
+	if !*g_no_commit {
+		git = exec.Command("git", "diff", "--cached", "--quiet", "--ignore-submodules=none")
+		debug(git)
+		err = git.Run()
+		if err != nil {
+			err = fmt.Errorf("the superproject has staged changes, which would be committed along with the removal (use -no-commit)")
+		}
+		utils.HandleErr(err)
 	}
 
-	// commit changes
-	git = exec.Command("git", "add", ".gitmodules")
-	debug(git)
-	err = git.Run()
+	for i := range subs {
+		// get submodule url, from .git/config or else .gitmodules
+		subs[i].url = "unknown"
+		for _, args := range [][]string{
+			{"config", "--get"},
+			{"config", "-f", ".gitmodules", "--get"},
+		} {
+			args = append(args, fmt.Sprintf("submodule.%s.url", subs[i].name))
+			bout, err = exec.Command("git", args...).Output()
+			if err == nil {
+				subs[i].url = strings.Trim(string(bout), " \r\n")
+				break
+			}
+		}
+	}
+
+	verb := "removed"
+	if *g_keep_worktree {
+		verb = "vendored"
+	}
+	msg, err := message(verb, subs, *g_keep_worktree)
 	utils.HandleErr(err)
+	supers := []superproject{}
+	if *g_recursive {
+		// commit the new gitlink in all the superprojects of this one
+		supers, err = superprojects(top)
+		utils.HandleErr(err)
+	}
+
+	root, err := backupRoot(gitdir)
+	utils.HandleErr(err)
+
+	plan, err := removalPlan(top, gitdir, root, subs, msg, supers)
+	utils.HandleErr(err)
+
+	if *g_dry_run {
+		for _, sub := range subs {
+			fmt.Printf("would remove submodule [%s] (url=%s)\n", sub.path, sub.url)
+		}
+		printPlan(top, plan, msg)
+		return
+	}
+
+	// ask before deleting anything, when someone may answer
+	if !*g_yes && isTerminal(os.Stdin) {
+		ok, err := confirm(os.Stdin, os.Stdout, subs, gitdir)
+		utils.HandleErr(err)
+		if !ok {
+			err = fmt.Errorf("aborted: nothing was removed")
+			utils.HandleErr(err)
+		}
+	}
 
-	git = exec.Command(
-		"git", "commit", "-m",
-		fmt.Sprintf("removed submodule [%s] (url=%s)", dir, url),
-	)
-	debug(git)
-	err = git.Run()
+	err = runPlan(plan)
 	utils.HandleErr(err)
 
-	// TODO: commit in super repositories of this one as well
+	fmt.Printf("backup of the removed submodules in [%s]\n", root)
 }
 
 // EOF
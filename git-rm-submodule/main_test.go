@@ -1,16 +1,30 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/mana-fwk/git-tools/utils"
 )
 
+// run_git runs git with args in directory dir and returns its output,
+// failing the test if it fails.
+func run_git(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	bout, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%v", args, err, string(bout))
+	}
+	return string(bout)
+}
+
 func get_gitroot() (string, error) {
 	// create temporary root tempdir
 	g_gitroot, err := ioutil.TempDir("", "git-rm-submodule-test-")
@@ -207,20 +221,975 @@ func TestUncleanSubmodule(t *testing.T) {
 		t.Error(err)
 	}
 
-	// removing any submodule should fail
+	// removing the non-clean submodule should fail
+	cmd := exec.Command(
+		"git",
+		"rm-submodule", filepath.Join("src", "sub-repo-0"),
+	)
+	cmd.Dir = gitroot
+	bout, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Errorf("rm-submodule %s should have failed.\noutput: %v\n",
+			filepath.Join("src", "sub-repo-0"), string(bout))
+	}
+	if !strings.Contains(string(bout), "submodule [src/sub-repo-0] is not safe to remove (git check-clean") {
+		t.Errorf("failure not attributed to the submodule:\n%v", string(bout))
+	}
+
+	// the other one is not concerned
+	cmd = exec.Command(
+		"git",
+		"rm-submodule", filepath.Join("src", "sub-repo-1"),
+	)
+	cmd.Dir = gitroot
+	bout, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Errorf("rm-submodule %s should have succeeded: %v\noutput: %v\n",
+			filepath.Join("src", "sub-repo-1"), err, string(bout))
+	}
+}
+
+func TestSeveralSubmodules(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+
+	cmd := exec.Command("git", "rev-list", "--count", "HEAD")
+	cmd.Dir = gitroot
+	bout, err := cmd.Output()
+	if err != nil {
+		t.Error(err)
+	}
+	ncommits := string(bout)
+
+	// unknown submodules are rejected before anything is removed
+	cmd = exec.Command("git", "rm-submodule", "src/sub-repo-0", "src/no-such-repo")
+	cmd.Dir = gitroot
+	bout, err = cmd.CombinedOutput()
+	if err == nil {
+		t.Errorf("rm-submodule should have failed.\noutput: %v\n", string(bout))
+	}
+	if !utils.PathExists(filepath.Join(gitroot, "src", "sub-repo-0", "file.txt")) {
+		t.Errorf("submodule [src/sub-repo-0] should not have been removed")
+	}
+
+	// remove all submodules, from a sub-directory, with a glob
+	cmd = exec.Command("git", "rm-submodule", "sub-repo-*")
+	cmd.Dir = filepath.Join(gitroot, "src")
+	bout, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Errorf("error: %v\noutput: %v\n", err, string(bout))
+	}
+
+	cmd = exec.Command("git", "submodule", "foreach", "")
+	cmd.Dir = gitroot
+	bout, err = cmd.Output()
+	if err != nil {
+		t.Error(err)
+	}
+	if string(bout) != "" {
+		t.Errorf("submodules were not removed: %v\n", string(bout))
+	}
+
+	// in one commit, listing all submodules
+	cmd = exec.Command("git", "rev-list", "--count", "HEAD~1")
+	cmd.Dir = gitroot
+	bout, err = cmd.Output()
+	if err != nil {
+		t.Error(err)
+	}
+	if string(bout) != ncommits {
+		t.Errorf("submodules should have been removed in one commit")
+	}
+
+	cmd = exec.Command("git", "log", "-1", "--format=%B")
+	cmd.Dir = gitroot
+	bout, err = cmd.Output()
+	if err != nil {
+		t.Error(err)
+	}
 	for _, sub := range []string{"sub-repo-0", "sub-repo-1"} {
-		cmd := exec.Command(
-			"git",
-			"rm-submodule", filepath.Join("src", sub),
-		)
+		line := fmt.Sprintf("- src/%s (url=%s)", sub, filepath.Join(g_gitroot, sub))
+		if !strings.Contains(string(bout), line) {
+			t.Errorf("commit message does not list [%s]:\n%v", line, string(bout))
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+
+	cmd := exec.Command("git", "rm-submodule", "-dry-run", "src/sub-repo-0")
+	cmd.Dir = gitroot
+	bout, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Errorf("error: %v\noutput: %v\n", err, string(bout))
+	}
+	out := string(bout)
+	for _, expected := range []string{
+		"git config -f .gitmodules --remove-section submodule.src/sub-repo-0",
+		"git rm --cached src/sub-repo-0",
+		"mv " + filepath.Join(gitroot, ".git", "modules", "src", "sub-repo-0") + " " +
+			filepath.Join(gitroot, ".git", "rm-submodule-backup"),
+		"removed submodule [src/sub-repo-0]",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("plan does not contain [%s]:\n%v", expected, out)
+		}
+	}
+	if n := strings.Count(out, "git add .gitmodules"); n != 1 {
+		t.Errorf("plan stages .gitmodules %d times:\n%v", n, out)
+	}
+
+	// nothing changed
+	cmd = exec.Command("git", "status", "--porcelain")
+	cmd.Dir = gitroot
+	bout, err = cmd.Output()
+	if err != nil {
+		t.Error(err)
+	}
+	if string(bout) != "" {
+		t.Errorf("repository was modified:\n%v", string(bout))
+	}
+	for _, dir := range []string{
+		filepath.Join(gitroot, "src", "sub-repo-0", "file.txt"),
+		filepath.Join(gitroot, ".git", "modules", "src", "sub-repo-0"),
+	} {
+		if !utils.PathExists(dir) {
+			t.Errorf("[%s] was removed", dir)
+		}
+	}
+}
+
+func TestRecursiveCommit(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	// an outer repository with 'work' as a submodule
+	outer := filepath.Join(g_gitroot, "outer")
+	for _, args := range [][]string{
+		{"init", outer},
+		{"-C", outer, "-c", "protocol.file.allow=always", "submodule", "add", filepath.Join(g_gitroot, "work"), "work"},
+		{"-C", outer, "-c", "protocol.file.allow=always", "submodule", "update", "--init", "--recursive"},
+		{"-C", outer, "commit", "-m", "adding work"},
+	} {
+		cmd := exec.Command("git", args...)
+		bout, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\noutput: %v\n", args, err, string(bout))
+		}
+	}
+
+	gitroot := filepath.Join(outer, "work")
+	cmd := exec.Command("git", "rm-submodule", "-recursive-commit", "src/sub-repo-0")
+	cmd.Dir = gitroot
+	bout, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Errorf("error: %v\noutput: %v\n", err, string(bout))
+	}
+
+	// the outer repository has committed the new gitlink
+	cmd = exec.Command("git", "status", "--porcelain")
+	cmd.Dir = outer
+	bout, err = cmd.Output()
+	if err != nil {
+		t.Error(err)
+	}
+	if string(bout) != "" {
+		t.Errorf("outer repository is not clean:\n%v", string(bout))
+	}
+
+	cmd = exec.Command("git", "log", "-1", "--format=%B")
+	cmd.Dir = outer
+	bout, err = cmd.Output()
+	if err != nil {
+		t.Error(err)
+	}
+	for _, expected := range []string{"updated submodule [work]", "removed submodule [src/sub-repo-0]"} {
+		if !strings.Contains(string(bout), expected) {
+			t.Errorf("commit message does not contain [%s]:\n%v", expected, string(bout))
+		}
+	}
+}
+
+func TestSubmoduleByName(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+
+	// after a move, the submodule keeps its name but not its path
+	for _, args := range [][]string{
+		{"mv", filepath.Join("src", "sub-repo-1"), "renamed"},
+		{"commit", "-m", "moving sub-repo-1"},
+	} {
+		cmd := exec.Command("git", args...)
 		cmd.Dir = gitroot
 		bout, err := cmd.CombinedOutput()
-		if err == nil {
-			t.Errorf("rm-submodule %s should have failed.\noutput: %v\n",
-				filepath.Join("src", sub), string(bout))
+		if err != nil {
+			t.Fatalf("git %v: %v\n%v", args, err, string(bout))
+		}
+	}
+
+	// remove it by name
+	cmd := exec.Command("git", "rm-submodule", "src/sub-repo-1")
+	cmd.Dir = gitroot
+	bout, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("error: %v\noutput: %v\n", err, string(bout))
+	}
+
+	for _, dir := range []string{
+		filepath.Join(gitroot, "renamed"),
+		filepath.Join(gitroot, ".git", "modules", "src", "sub-repo-1"),
+	} {
+		if utils.PathExists(dir) {
+			t.Errorf("[%s] was not removed", dir)
+		}
+	}
+
+	bout, err = ioutil.ReadFile(filepath.Join(gitroot, ".gitmodules"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(bout), "sub-repo-1") {
+		t.Errorf(".gitmodules still describes the submodule:\n%v", string(bout))
+	}
+
+	cmd = exec.Command("git", "log", "-1", "--format=%B")
+	cmd.Dir = gitroot
+	bout, err = cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(bout), "removed submodule [renamed]") {
+		t.Errorf("unexpected commit message:\n%v", string(bout))
+	}
+
+	// the other one is still found by path
+	cmd = exec.Command("git", "rm-submodule", "-dry-run", "src/sub-repo-0")
+	cmd.Dir = gitroot
+	bout, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Errorf("error: %v\noutput: %v\n", err, string(bout))
+	}
+}
+
+// repoState describes everything a failed removal must leave unchanged in
+// the repository at top.
+func repoState(top string) (string, error) {
+	state := ""
+	for _, args := range [][]string{
+		{"rev-parse", "HEAD"},
+		{"ls-files", "--stage"},
+		{"config", "--local", "--list"},
+		{"status", "--porcelain", "--ignore-submodules=none"},
+		{"cat-file", "-p", ":.gitmodules"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = top
+		bout, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("git %v: %v", args, err)
+		}
+		state += fmt.Sprintf("git %v:\n%s\n", args, string(bout))
+	}
+	for _, fname := range []string{
+		filepath.Join(top, ".gitmodules"),
+		filepath.Join(top, "src", "sub-repo-0", "file.txt"),
+		filepath.Join(top, ".git", "modules", "src", "sub-repo-0", "HEAD"),
+	} {
+		bout, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return "", err
+		}
+		state += fmt.Sprintf("%s:\n%s\n", fname, string(bout))
+	}
+	return state, nil
+}
+
+func TestRollback(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(pwd)
+
+	for i := 0; ; i++ {
+		g_gitroot, err := get_gitroot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(g_gitroot)
+
+		gitroot := filepath.Join(g_gitroot, "work")
+		err = os.Chdir(gitroot)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		subs, err := findSubmodules([]string{"src/sub-repo-0"}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		gitdir := filepath.Join(gitroot, ".git")
+		root := filepath.Join(gitdir, "rm-submodule-backup")
+		plan, err := removalPlan(gitroot, gitdir, root, subs, commitMessage("removed", subs, false), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == len(plan) {
+			break
+		}
+
+		before, err := repoState(gitroot)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// make step i fail
+		desc := plan[i].desc
+		plan[i].run = func() error {
+			return fmt.Errorf("injected failure")
+		}
+
+		err = runPlan(plan)
+		if err == nil || !strings.Contains(err.Error(), "injected failure") {
+			t.Fatalf("step %d [%s]: expected an injected failure, got %v", i, desc, err)
+		}
+		backups, err := filepath.Glob(filepath.Join(root, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(backups) != 0 {
+			t.Errorf("step %d [%s]: backups left behind: %v", i, desc, backups)
+		}
+
+		after, err := repoState(gitroot)
+		if err != nil {
+			t.Errorf("step %d [%s]: %v", i, desc, err)
+			continue
+		}
+		if after != before {
+			t.Errorf("step %d [%s]: repository not restored.\nbefore:\n%s\nafter:\n%s", i, desc, before, after)
+		}
+	}
+}
+
+func TestFailedStepOutput(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+
+	// a commit-msg hook rejecting the commit message
+	err = ioutil.WriteFile(
+		filepath.Join(gitroot, ".git", "hooks", "commit-msg"),
+		[]byte("#!/bin/sh\necho 'commit message lacks a ticket number' >&2\nexit 1\n"),
+		0755,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("git", "rm-submodule", "src/sub-repo-0")
+	cmd.Dir = gitroot
+	bout, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("rm-submodule should have failed:\n%v", string(bout))
+	}
+	if !strings.Contains(string(bout), "commit message lacks a ticket number") {
+		t.Errorf("reason of the failure not reported:\n%v", string(bout))
+	}
+	if !utils.PathExists(filepath.Join(gitroot, "src", "sub-repo-0", "file.txt")) {
+		t.Errorf("removal was not rolled back")
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+	subdir := filepath.Join(gitroot, "src", "sub-repo-0")
+
+	// some local state which only lives in the submodule git dir
+	err = ioutil.WriteFile(filepath.Join(subdir, "file.txt"), []byte("stashed\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run_git(t, subdir, "stash")
+	gitlinks := run_git(t, gitroot, "ls-tree", "-r", "HEAD", "src")
+
+	backup := filepath.Join(g_gitroot, "backup")
+	run_git(t, gitroot, "rm-submodule", "-backup="+backup, "src/sub-repo-0")
+	if utils.PathExists(subdir) {
+		t.Fatalf("[%s] was not removed", subdir)
+	}
+	fnames, err := filepath.Glob(filepath.Join(backup, "*", "worktree", "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fnames) != 1 {
+		t.Fatalf("no backup of the working tree: %v", fnames)
+	}
+
+	run_git(t, gitroot, "rm-submodule", "-restore", "-backup="+backup, "src/sub-repo-0")
+
+	msg := run_git(t, gitroot, "log", "-1", "--format=%B")
+	if !strings.Contains(msg, "restored submodule [src/sub-repo-0]") {
+		t.Errorf("unexpected commit message:\n%v", msg)
+	}
+	url := filepath.Join(g_gitroot, "sub-repo-0") + "\n"
+	if out := run_git(t, gitroot, "config", "-f", ".gitmodules", "submodule.src/sub-repo-0.url"); out != url {
+		t.Errorf(".gitmodules not restored: url=%q", out)
+	}
+	if out := run_git(t, gitroot, "ls-tree", "-r", "HEAD", "src"); out != gitlinks {
+		t.Errorf("gitlinks not restored.\nexpected:\n%v\ngot:\n%v", gitlinks, out)
+	}
+	if out := run_git(t, gitroot, "status", "--porcelain", "--ignore-submodules=none"); out != "" {
+		t.Errorf("working tree not clean:\n%v", out)
+	}
+	if out := run_git(t, subdir, "stash", "list"); out == "" {
+		t.Errorf("stash was lost")
+	}
+	if utils.PathExists(fnames[0]) {
+		t.Errorf("backup [%s] was not removed", fnames[0])
+	}
+}
+
+func TestCrossDeviceBackup(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	// a backup directory on another filesystem
+	backup, err := ioutil.TempDir("/dev/shm", "git-rm-submodule-backup-")
+	if err != nil {
+		t.Skipf("no tmpfs to back up to: %v", err)
+	}
+	defer os.RemoveAll(backup)
+	probe := filepath.Join(g_gitroot, "probe")
+	err = ioutil.WriteFile(probe, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(probe, filepath.Join(backup, "probe"))
+	if err == nil {
+		t.Skipf("[%s] is on the same filesystem as [%s]", backup, g_gitroot)
+	}
+
+	gitroot := filepath.Join(g_gitroot, "work")
+	subdir := filepath.Join(gitroot, "src", "sub-repo-0")
+
+	err = ioutil.WriteFile(filepath.Join(subdir, "file.txt"), []byte("stashed\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run_git(t, subdir, "stash")
+
+	run_git(t, gitroot, "rm-submodule", "-backup="+backup, "src/sub-repo-0")
+	if utils.PathExists(subdir) {
+		t.Fatalf("[%s] was not removed", subdir)
+	}
+	if utils.PathExists(filepath.Join(gitroot, ".git", "modules", "src", "sub-repo-0")) {
+		t.Fatalf("git dir of [%s] was not removed", subdir)
+	}
+	for _, pattern := range []string{"worktree/file.txt", "gitdir/HEAD"} {
+		fnames, err := filepath.Glob(filepath.Join(backup, "*", filepath.FromSlash(pattern)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fnames) != 1 {
+			t.Errorf("no [%s] in backup [%s]", pattern, backup)
+		}
+	}
+
+	run_git(t, gitroot, "rm-submodule", "-restore", "-backup="+backup, "src/sub-repo-0")
+	if out := run_git(t, gitroot, "status", "--porcelain", "--ignore-submodules=none"); out != "" {
+		t.Errorf("working tree not clean:\n%v", out)
+	}
+	if out := run_git(t, subdir, "stash", "list"); out == "" {
+		t.Errorf("stash was lost")
+	}
+}
+
+func TestRelativeBackup(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+	src := filepath.Join(gitroot, "src")
+
+	// relative to the current directory, not to the top of the repository
+	run_git(t, src, "rm-submodule", "-backup=bk", "sub-repo-0")
+	if utils.PathExists(filepath.Join(gitroot, "bk")) {
+		t.Errorf("backup created in the top directory")
+	}
+	dirs, err := filepath.Glob(filepath.Join(src, "bk", "*", backupInfoName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 1 {
+		t.Fatalf("no backup in [%s]", filepath.Join(src, "bk"))
+	}
+
+	dir, err := filepath.Rel(src, filepath.Dir(dirs[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	run_git(t, src, "rm-submodule", "-restore", dir)
+	if !utils.PathExists(filepath.Join(src, "sub-repo-0", "file.txt")) {
+		t.Errorf("submodule [src/sub-repo-0] not restored")
+	}
+}
+
+func TestNestedSubmodules(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+	subdir := filepath.Join(gitroot, "src", "sub-repo-0")
+
+	// src/sub-repo-0/nested is a checkout of sub-repo-1
+	for _, args := range [][]string{
+		{"-C", subdir, "-c", "protocol.file.allow=always", "submodule", "add", filepath.Join(g_gitroot, "sub-repo-1"), "nested"},
+		{"-C", subdir, "commit", "-m", "adding nested"},
+		{"-C", gitroot, "commit", "-a", "-m", "updating sub-repo-0"},
+	} {
+		cmd := exec.Command("git", args...)
+		bout, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%v", args, err, string(bout))
+		}
+	}
+
+	// work in the nested submodule is not lost
+	untracked := filepath.Join(subdir, "nested", "untracked.txt")
+	err = ioutil.WriteFile(untracked, []byte("not committed\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("git", "rm-submodule", "src/sub-repo-0")
+	cmd.Dir = gitroot
+	bout, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("removing a submodule with a dirty nested submodule should fail")
+	}
+	if !strings.Contains(string(bout), "submodule [src/sub-repo-0/nested]") {
+		t.Errorf("failure not attributed to the nested submodule:\n%v", string(bout))
+	}
+	if !utils.PathExists(untracked) {
+		t.Fatalf("[%s] was removed", untracked)
+	}
+
+	err = os.Remove(untracked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command("git", "rm-submodule", "src/sub-repo-0")
+	cmd.Dir = gitroot
+	bout, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("error: %v\noutput: %v\n", err, string(bout))
+	}
+	for _, dir := range []string{
+		subdir,
+		filepath.Join(gitroot, ".git", "modules", "src", "sub-repo-0"),
+	} {
+		if utils.PathExists(dir) {
+			t.Errorf("[%s] was not removed", dir)
+		}
+	}
+	nested, err := filepath.Glob(filepath.Join(gitroot, ".git", "rm-submodule-backup", "*", "gitdir", "modules", "nested", "HEAD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nested) != 1 {
+		t.Errorf("git dir of the nested submodule not backed up")
+	}
+}
+
+func TestKeepWorktree(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+	subdir := filepath.Join(gitroot, "src", "sub-repo-0")
+
+	sha := strings.Fields(run_git(t, gitroot, "ls-files", "--stage", "src/sub-repo-0"))[1]
+	run_git(t, gitroot, "rm-submodule", "-keep-worktree", "src/sub-repo-0")
+
+	if !utils.PathExists(filepath.Join(subdir, "file.txt")) {
+		t.Fatalf("checked out files were removed")
+	}
+	for _, dir := range []string{
+		filepath.Join(subdir, ".git"),
+		filepath.Join(gitroot, ".git", "modules", "src", "sub-repo-0"),
+	} {
+		if utils.PathExists(dir) {
+			t.Errorf("[%s] was not removed", dir)
+		}
+	}
+
+	out := run_git(t, gitroot, "ls-files", "--stage", "src/sub-repo-0")
+	if !strings.HasPrefix(out, "100") || !strings.Contains(out, "src/sub-repo-0/file.txt") {
+		t.Errorf("files not tracked by the superproject:\n%v", out)
+	}
+	if out := run_git(t, gitroot, "status", "--porcelain"); out != "" {
+		t.Errorf("working tree not clean:\n%v", out)
+	}
+
+	msg := run_git(t, gitroot, "log", "-1", "--format=%B")
+	for _, expected := range []string{
+		"vendored submodule [src/sub-repo-0]",
+		"url=" + filepath.Join(g_gitroot, "sub-repo-0"),
+		"sha=" + sha,
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("commit message does not contain [%s]:\n%v", expected, msg)
+		}
+	}
+}
+
+func TestStagedSuperproject(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+
+	err = ioutil.WriteFile(filepath.Join(gitroot, "staged.txt"), []byte("staged\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("git", "add", "staged.txt")
+	cmd.Dir = gitroot
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// staged.txt would end up in the removal commit
+	cmd = exec.Command("git", "rm-submodule", "src/sub-repo-0")
+	cmd.Dir = gitroot
+	bout, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Errorf("rm-submodule should have failed.\noutput: %v\n", string(bout))
+	}
+	if !strings.Contains(string(bout), "staged changes") {
+		t.Errorf("unexpected output:\n%v", string(bout))
+	}
+
+	cmd = exec.Command("git", "rm-submodule", "-no-commit", "src/sub-repo-0")
+	cmd.Dir = gitroot
+	bout, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Errorf("error: %v\noutput: %v\n", err, string(bout))
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(pwd)
+
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+	subdir := filepath.Join(gitroot, "src", "sub-repo-0")
+
+	// a stash and a local branch, with a commit which was never pushed
+	err = ioutil.WriteFile(filepath.Join(subdir, "file.txt"), []byte("stashed\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"stash"},
+		{"checkout", "-q", "-b", "wip"},
+		{"commit", "--allow-empty", "-m", "work in progress"},
+		{"checkout", "-q", "-"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = subdir
+		bout, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%v", args, err, string(bout))
+		}
+	}
+
+	err = os.Chdir(gitroot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subs, err := findSubmodules([]string{"src/sub-repo-0"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subs[0].url = "https://example.com/sub-repo-0"
+	gitdir := filepath.Join(gitroot, ".git")
+
+	for _, answer := range []string{"", "n\n", "y\n", "yes\n"} {
+		var out bytes.Buffer
+		ok, err := confirm(strings.NewReader(answer), &out, subs, gitdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := strings.HasPrefix(answer, "y"); ok != expected {
+			t.Errorf("answer %q: expected %v, got %v", answer, expected, ok)
+		}
+		for _, expected := range []string{
+			"submodule [src/sub-repo-0]",
+			"url:              https://example.com/sub-repo-0",
+			"commit:           " + subs[0].sha + "\n",
+			"stashes:          1",
+			"local branches:   wip",
+			"unpushed commits: 1",
+			"git dir:          " + filepath.Join(gitdir, "modules", "src", "sub-repo-0"),
+			"remove submodule? [y/N]",
+		} {
+			if !strings.Contains(out.String(), expected) {
+				t.Errorf("summary does not contain [%s]:\n%v", expected, out.String())
+			}
+		}
+	}
+}
+
+func TestCommitMessageOptions(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+
+	out := run_git(t, gitroot, "rm-submodule", "-dry-run", "-signoff", "-gpg-sign=0xC0FFEE", "src/sub-repo-0")
+	if !strings.Contains(out, "git commit -m <commit message> --signoff --gpg-sign=0xC0FFEE") {
+		t.Errorf("commit options not used:\n%v", out)
+	}
+	out = run_git(t, gitroot, "rm-submodule", "-dry-run", "-gpg-sign", "-gpg-sign=false", "src/sub-repo-0")
+	if strings.Contains(out, "--gpg-sign") {
+		t.Errorf("-gpg-sign=false still signs:\n%v", out)
+	}
+
+	run_git(t, gitroot, "rm-submodule", "-m", "chore: drop sub-repo-0", "-signoff", "src/sub-repo-0")
+	msg := run_git(t, gitroot, "log", "-1", "--format=%B")
+	if !strings.HasPrefix(msg, "chore: drop sub-repo-0\n") || !strings.Contains(msg, "Signed-off-by: ") {
+		t.Errorf("unexpected commit message:\n%v", msg)
+	}
+
+	sha := strings.Fields(run_git(t, gitroot, "ls-files", "--stage", "src/sub-repo-1"))[1]
+	run_git(t, gitroot, "rm-submodule", "-message-template", "chore: {{.Action}} {{.Name}}\n\nurl: {{.URL}}\nsha: {{.SHA}}\n", "src/sub-repo-1")
+	msg = run_git(t, gitroot, "log", "-1", "--format=%B")
+	expected := fmt.Sprintf(
+		"chore: removed src/sub-repo-1\n\nurl: %s\nsha: %s\n",
+		filepath.Join(g_gitroot, "sub-repo-1"), sha,
+	)
+	if strings.TrimSpace(msg) != strings.TrimSpace(expected) {
+		t.Errorf("unexpected commit message.\nexpected:\n%v\ngot:\n%v", expected, msg)
+	}
+}
+
+func TestLinkedWorktrees(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+	wt := filepath.Join(g_gitroot, "wt")
+
+	// both submodules were checked out in a linked worktree, on a branch
+	// which no longer has sub-repo-1 (only its git dir is left) and has
+	// sub-repo-0 under another path
+	run_git(t, gitroot, "worktree", "add", "-b", "other", wt)
+	run_git(t, wt, "-c", "protocol.file.allow=always", "submodule", "update", "--init")
+	run_git(t, wt, "rm", "-q", "src/sub-repo-1")
+	err = os.Mkdir(filepath.Join(wt, "lib"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run_git(t, wt, "mv", "src/sub-repo-0", "lib/sub-repo-0")
+	run_git(t, wt, "commit", "-m", "dropping sub-repo-1, moving sub-repo-0")
+
+	// with some per-worktree configuration of sub-repo-1 there
+	run_git(t, gitroot, "config", "extensions.worktreeConfig", "true")
+	run_git(t, wt, "config", "--worktree", "submodule.src/sub-repo-1.update", "rebase")
+
+	wtgitdir := strings.TrimSpace(run_git(t, wt, "rev-parse", "--absolute-git-dir"))
+	for _, dir := range []string{
+		filepath.Join(wtgitdir, "modules", "src", "sub-repo-0"),
+		filepath.Join(wtgitdir, "modules", "src", "sub-repo-1"),
+	} {
+		if !utils.PathExists(dir) {
+			t.Fatalf("[%s] does not exist", dir)
 		}
 	}
 
+	out := run_git(t, gitroot, "rm-submodule", "src/sub-repo-0", "src/sub-repo-1")
+	expected := "submodule [src/sub-repo-0] is still used in worktree [" + wt + "] (as [lib/sub-repo-0])"
+	if !strings.Contains(out, expected) {
+		t.Errorf("output does not contain [%s]:\n%v", expected, out)
+	}
+
+	// the stale git dir is gone, the one still in use is kept with its
+	// configuration
+	if utils.PathExists(filepath.Join(wtgitdir, "modules", "src", "sub-repo-1")) {
+		t.Errorf("stale git dir of sub-repo-1 in the linked worktree was not removed")
+	}
+	if !utils.PathExists(filepath.Join(wtgitdir, "modules", "src", "sub-repo-0")) {
+		t.Errorf("git dir of sub-repo-0 in the linked worktree was removed")
+	}
+	if out := run_git(t, wt, "config", "submodule.src/sub-repo-0.url"); strings.TrimSpace(out) == "" {
+		t.Errorf("configuration of sub-repo-0 was removed")
+	}
+	if out := run_git(t, wt, "status", "--porcelain", "--", "lib/sub-repo-0"); out != "" {
+		t.Errorf("sub-repo-0 is broken in the linked worktree:\n%v", out)
+	}
+	wtconfig := filepath.Join(wtgitdir, "config.worktree")
+	if out := run_git(t, wt, "config", "-f", wtconfig, "--list"); strings.Contains(out, "sub-repo-1") {
+		t.Errorf("per-worktree configuration of sub-repo-1 was not removed:\n%v", out)
+	}
+
+	// and all of it comes back with -restore
+	run_git(t, gitroot, "rm-submodule", "-restore", "src/sub-repo-1")
+	if !utils.PathExists(filepath.Join(wtgitdir, "modules", "src", "sub-repo-1", "HEAD")) {
+		t.Errorf("stale git dir of sub-repo-1 in the linked worktree was not restored")
+	}
+	if out := run_git(t, wt, "config", "-f", wtconfig, "submodule.src/sub-repo-1.update"); strings.TrimSpace(out) != "rebase" {
+		t.Errorf("per-worktree configuration of sub-repo-1 was not restored: %q", out)
+	}
+	backups, err := filepath.Glob(filepath.Join(gitroot, ".git", "rm-submodule-backup", "*-src_sub-repo-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 0 {
+		t.Errorf("backup of sub-repo-1 was not removed: %v", backups)
+	}
+}
+
+func TestStaleCheckoutInLinkedWorktree(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+	wt := filepath.Join(g_gitroot, "wt")
+	stale := filepath.Join(wt, "src", "sub-repo-1")
+
+	// a linked worktree on a branch without sub-repo-1, whose checkout
+	// is still there with uncommitted work
+	run_git(t, gitroot, "worktree", "add", "-b", "other", wt)
+	run_git(t, wt, "-c", "protocol.file.allow=always", "submodule", "update", "--init")
+	run_git(t, wt, "rm", "-q", "--cached", "src/sub-repo-1")
+	run_git(t, wt, "commit", "-m", "dropping sub-repo-1 from the index only")
+	err = ioutil.WriteFile(filepath.Join(stale, "wip"), []byte("work in progress\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wtgitdir := strings.TrimSpace(run_git(t, wt, "rev-parse", "--absolute-git-dir"))
+
+	out := run_git(t, gitroot, "rm-submodule", "src/sub-repo-1")
+	expected := "stale checkout of submodule [src/sub-repo-1] in worktree [" + wt + "]"
+	if !strings.Contains(out, expected) {
+		t.Errorf("output does not contain [%s]:\n%v", expected, out)
+	}
+
+	// the checkout is left in place along with its git dir, still usable
+	if !utils.PathExists(filepath.Join(wtgitdir, "modules", "src", "sub-repo-1")) {
+		t.Errorf("git dir of the stale checkout of sub-repo-1 was removed")
+	}
+	if out := run_git(t, stale, "status", "--porcelain"); !strings.Contains(out, "wip") {
+		t.Errorf("uncommitted work of the stale checkout is lost:\n%v", out)
+	}
+}
+
+func TestExternalGitDir(t *testing.T) {
+	g_gitroot, err := get_gitroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(g_gitroot)
+
+	gitroot := filepath.Join(g_gitroot, "work")
+	subdir := filepath.Join(gitroot, "src", "sub-repo-0")
+	external := filepath.Join(g_gitroot, "external.git")
+
+	// the .git file of the submodule points outside of the superproject
+	err = os.Rename(filepath.Join(gitroot, ".git", "modules", "src", "sub-repo-0"), external)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(subdir, ".git"), []byte("gitdir: "+external+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("git", "config", "-f", filepath.Join(external, "config"), "core.worktree", subdir)
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd = exec.Command("git", "rm-submodule", "src/sub-repo-0")
+	cmd.Dir = gitroot
+	bout, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("error: %v\noutput: %v\n", err, string(bout))
+	}
+	if !strings.Contains(string(bout), "git dir ["+external+"] of submodule [src/sub-repo-0]") {
+		t.Errorf("external git dir not reported:\n%v", string(bout))
+	}
+	if utils.PathExists(subdir) {
+		t.Errorf("[%s] was not removed", subdir)
+	}
+	if !utils.PathExists(filepath.Join(external, "HEAD")) {
+		t.Errorf("external git dir [%s] was removed", external)
+	}
 }
 
 // EOF
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// optionalString is a flag.Value which may be given with or without a
+// value, like git's --gpg-sign[=<keyid>].
+type optionalString struct {
+	set   bool
+	value string // empty when given without a value
+}
+
+func (o *optionalString) String() string {
+	return o.value
+}
+
+func (o *optionalString) Set(v string) error {
+	switch v {
+	case "true":
+		// given without a value
+		o.set, o.value = true, ""
+	case "false":
+		// like any other boolean flag
+		o.set, o.value = false, ""
+	default:
+		o.set, o.value = true, v
+	}
+	return nil
+}
+
+func (o *optionalString) IsBoolFlag() bool {
+	return true
+}
+
+// messageSubmodule describes a submodule to -message-template.
+type messageSubmodule struct {
+	Path string
+	Name string
+	URL  string
+	SHA  string
+}
+
+// messageData is what -message-template is executed with. With several
+// submodules, Path, Name, URL and SHA hold the comma separated values of
+// all of them.
+type messageData struct {
+	Action string // removed, restored or vendored
+	messageSubmodule
+	Submodules []messageSubmodule
+}
+
+// message returns the commit message for subs, removed (or restored,
+// vendored...) as told by verb: the one given with -m, or else the one
+// made from -message-template, or else commitMessage(verb, subs, sha).
+func message(verb string, subs []submodule, sha bool) (string, error) {
+	if *g_message != "" {
+		return *g_message, nil
+	}
+	if *g_message_template == "" {
+		return commitMessage(verb, subs, sha), nil
+	}
+
+	tmpl, err := template.New("message").Option("missingkey=error").Parse(*g_message_template)
+	if err != nil {
+		return "", fmt.Errorf("invalid -message-template: %v", err)
+	}
+
+	data := messageData{Action: verb}
+	var paths, names, urls, shas []string
+	for _, sub := range subs {
+		data.Submodules = append(data.Submodules, messageSubmodule{
+			Path: sub.path,
+			Name: sub.name,
+			URL:  sub.url,
+			SHA:  sub.sha,
+		})
+		paths = append(paths, sub.path)
+		names = append(names, sub.name)
+		urls = append(urls, sub.url)
+		shas = append(shas, sub.sha)
+	}
+	data.Path = strings.Join(paths, ", ")
+	data.Name = strings.Join(names, ", ")
+	data.URL = strings.Join(urls, ", ")
+	data.SHA = strings.Join(shas, ", ")
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("invalid -message-template: %v", err)
+	}
+	if strings.TrimSpace(buf.String()) == "" {
+		return "", fmt.Errorf("-message-template gives an empty commit message")
+	}
+	return buf.String(), nil
+}
+
+// commitFlags returns the options of the commits made, from -signoff and
+// -gpg-sign.
+func commitFlags() []string {
+	args := []string{}
+	if *g_signoff {
+		args = append(args, "--signoff")
+	}
+	if g_gpg_sign.set {
+		if g_gpg_sign.value == "" {
+			args = append(args, "--gpg-sign")
+		} else {
+			args = append(args, "--gpg-sign="+g_gpg_sign.value)
+		}
+	}
+	return args
+}
+
+// EOF
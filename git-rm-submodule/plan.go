@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/mana-fwk/git-tools/utils"
+)
+
+// action is one step of the removal of submodules.
+type action struct {
+	desc string       // shell equivalent of the action, for -dry-run
+	run  func() error // performs the action
+	undo func() error // reverts a successful run, if not nil
+}
+
+// shellQuote quotes arg for a shell, if needed.
+func shellQuote(arg string) string {
+	if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=@:+,") == "" {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// gitAction returns an action running git with args.
+func gitAction(args ...string) action {
+	return gitActionIn("", args...)
+}
+
+// gitActionIn returns an action running git with args in directory dir.
+func gitActionIn(dir string, args ...string) action {
+	desc := []string{"git"}
+	for _, arg := range args {
+		desc = append(desc, shellQuote(arg))
+	}
+	a := action{
+		desc: strings.Join(desc, " "),
+		run: func() error {
+			return runGit(dir, args...)
+		},
+	}
+	if dir != "" {
+		a.desc = fmt.Sprintf("(cd %s && %s)", shellQuote(dir), a.desc)
+	}
+	return a
+}
+
+// runGit runs git with args in directory dir. Unless shown with -verbose,
+// what git reports on stderr is part of the returned error.
+func runGit(dir string, args ...string) error {
+	git := exec.Command("git", args...)
+	git.Dir = dir
+	debug(git)
+	var out bytes.Buffer
+	if git.Stderr == nil {
+		git.Stderr = &out
+	}
+	err := git.Run()
+	if err != nil {
+		msg := err.Error()
+		for _, line := range strings.Split(strings.TrimRight(out.String(), "\n"), "\n") {
+			if line != "" {
+				msg += "\n  " + line
+			}
+		}
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
+
+// snapshot returns action a, saving the content of files before it is run
+// so that undoing it restores them.
+// Files which did not exist are removed on undo.
+func snapshot(a action, files ...string) action {
+	run := a.run
+	saved := make([][]byte, len(files))
+	exists := make([]bool, len(files))
+	a.run = func() error {
+		for i, fname := range files {
+			data, err := ioutil.ReadFile(fname)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			saved[i], exists[i] = data, err == nil
+		}
+		return run()
+	}
+	a.undo = func() error {
+		for i, fname := range files {
+			if !exists[i] {
+				err := os.Remove(fname)
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				continue
+			}
+			err := ioutil.WriteFile(fname, saved[i], 0644)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return a
+}
+
+// commitAction returns an action committing in directory dir with message
+// msg, signed as asked with -signoff and -gpg-sign. Undoing it moves HEAD
+// back to where it was, keeping the index.
+func commitAction(dir, msg string, args ...string) action {
+	args = append(commitFlags(), args...)
+	a := gitActionIn(dir, append([]string{"commit", "-m", msg}, args...)...)
+	a.desc = "git commit -m <commit message>"
+	for _, arg := range args {
+		a.desc += " " + shellQuote(arg)
+	}
+	if dir != "" {
+		a.desc = fmt.Sprintf("(cd %s && %s)", shellQuote(dir), a.desc)
+	}
+
+	run := a.run
+	head := ""
+	a.run = func() error {
+		git := exec.Command("git", "rev-parse", "-q", "--verify", "HEAD")
+		git.Dir = dir
+		bout, _ := git.Output()
+		head = strings.Trim(string(bout), " \r\n")
+		return run()
+	}
+	a.undo = func() error {
+		if head == "" {
+			// there was no commit yet
+			return runGit(dir, "update-ref", "-d", "HEAD")
+		}
+		return runGit(dir, "reset", "-q", "--soft", head)
+	}
+	return a
+}
+
+// copyTree copies file or directory src to dst, keeping the permissions
+// and symbolic links.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(fname string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, fname)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			return os.Mkdir(target, fi.Mode().Perm()|0700)
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(fname)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !fi.Mode().IsRegular():
+			return fmt.Errorf("can not copy [%s]: not a regular file", fname)
+		}
+
+		r, err := os.Open(fname)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		w, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		if err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	})
+}
+
+// move renames src to dst or, if they are on different filesystems, copies
+// src to dst and then removes it.
+func move(src, dst string) error {
+	err := os.Rename(src, dst)
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+	err = copyTree(src, dst)
+	if err != nil {
+		// leave src untouched
+		os.RemoveAll(dst)
+		return fmt.Errorf("could not copy [%s] to [%s]: %v", src, dst, err)
+	}
+	return os.RemoveAll(src)
+}
+
+// moveAction returns an action moving the file or directory src to dst.
+// Undoing it also removes the parent directories of dst it created.
+func moveAction(src, dst string) action {
+	created := ""
+	return action{
+		desc: fmt.Sprintf("mv %s %s", shellQuote(src), shellQuote(dst)),
+		run: func() error {
+			for dir := filepath.Dir(dst); !utils.PathExists(dir); dir = filepath.Dir(dir) {
+				created = dir
+			}
+			err := os.MkdirAll(filepath.Dir(dst), 0755)
+			if err != nil {
+				return err
+			}
+			return move(src, dst)
+		},
+		undo: func() error {
+			err := move(dst, src)
+			if err != nil {
+				return err
+			}
+			for dir := filepath.Dir(dst); created != ""; dir = filepath.Dir(dir) {
+				err = os.Remove(dir)
+				if err != nil || dir == created {
+					break
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// gitPath returns the absolute path of name inside the git directory of the
+// repository at dir, as resolved by 'git rev-parse --git-path'.
+func gitPath(dir, name string) (string, error) {
+	git := exec.Command("git", "rev-parse", "--git-path", name)
+	git.Dir = dir
+	bout, err := git.Output()
+	if err != nil {
+		return "", fmt.Errorf("could not locate [%s] in [%s]: %v", name, dir, err)
+	}
+	fname := strings.Trim(string(bout), " \r\n")
+	if !filepath.IsAbs(fname) {
+		if dir == "" {
+			dir, err = os.Getwd()
+			if err != nil {
+				return "", err
+			}
+		}
+		fname = filepath.Join(dir, fname)
+	}
+	return fname, nil
+}
+
+// removalPlan returns the actions removing subs from the repository at top
+// (the current directory), whose git directory is gitdir. Unless -no-commit
+// is given, the removal is committed with message msg, and the new gitlink
+// then committed in supers.
+//
+// With -keep-worktree, the working copies are kept and added as plain
+// tracked files instead.
+//
+// The working copies and git directories of the submodules are not deleted
+// but moved to a backup under root (along with the ones of their nested
+// submodules, which live inside them), once the index and the configuration
+// have been updated, so that if an action fails the ones already run can be
+// undone, leaving the repository as it was.
+func removalPlan(top, gitdir, root string, subs []submodule, msg string, supers []superproject) ([]action, error) {
+	config, err := gitPath("", "config")
+	if err != nil {
+		return nil, err
+	}
+	index, err := gitPath("", "index")
+	if err != nil {
+		return nil, err
+	}
+	gitmodules := filepath.Join(top, ".gitmodules")
+
+	wts, err := linkedWorktrees(top)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]*backup, 0, len(subs))
+	plan := []action{}
+	for _, sub := range subs {
+		moddir, external, err := moduleDir(gitdir, filepath.Join(top, sub.path), sub)
+		if err != nil {
+			return nil, err
+		}
+		if external != "" {
+			warnf("git dir [%s] of submodule [%s] is not under [%s]: left in place\n", external, sub.path, gitdir)
+		}
+		b, err := newBackup(root, gitdir, moddir, sub)
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, b)
+
+		// the repository configuration is shared by all the working trees
+		for _, wt := range wts {
+			used, err := usedIn(wt, sub)
+			if err != nil {
+				return nil, err
+			}
+			if used != "" && len(b.info.Config) > 0 {
+				warnf("submodule [%s] is still used in worktree [%s] (as [%s]): its configuration is kept\n", sub.path, wt.dir, used)
+				b.info.Config = nil
+			}
+		}
+
+		// remove config entries
+		plan = append(plan,
+			snapshot(gitAction(
+				"config", "-f", ".gitmodules", "--remove-section",
+				fmt.Sprintf("submodule.%s", sub.name),
+			), gitmodules),
+		)
+		if len(b.info.Config) > 0 {
+			plan = append(plan,
+				snapshot(gitAction(
+					"config", "--remove-section",
+					fmt.Sprintf("submodule.%s", sub.name),
+				), config),
+			)
+		}
+		plan = append(plan,
+			// git-rm refuses to proceed with unstaged changes to .gitmodules
+			snapshot(gitAction("add", ".gitmodules"), index),
+			snapshot(gitAction("rm", "--cached", sub.path), index),
+		)
+	}
+
+	if *g_keep_worktree {
+		// turn the checked out files into plain tracked files: they must not
+		// be seen as (nested) repositories by git-add anymore.
+		for i, sub := range subs {
+			b := backups[i]
+			dir := filepath.Join(top, sub.path)
+			dotgits, err := findDotGits(dir)
+			if err != nil {
+				return nil, err
+			}
+			plan = append(plan, b.saveAction())
+			for _, rel := range dotgits {
+				plan = append(plan, moveAction(
+					filepath.Join(dir, rel),
+					filepath.Join(b.dir, "dotgit", rel),
+				))
+			}
+			plan = append(plan, snapshot(gitAction("add", "--", sub.path), index))
+		}
+	}
+
+	commits, err := commitPlan(msg, supers)
+	if err != nil {
+		return nil, err
+	}
+	plan = append(plan, commits...)
+
+	for i, sub := range subs {
+		b := backups[i]
+		if !*g_keep_worktree {
+			plan = append(plan,
+				b.saveAction(),
+				moveAction(filepath.Join(top, sub.path), filepath.Join(b.dir, "worktree")),
+			)
+		}
+		if b.info.GitDir != "" {
+			plan = append(plan, moveAction(
+				filepath.Join(gitdir, filepath.FromSlash(b.info.GitDir)),
+				filepath.Join(b.dir, "gitdir"),
+			))
+		}
+	}
+
+	// leftovers in the other working trees
+	leftovers, err := worktreePlan(top, wts, subs, backups)
+	if err != nil {
+		return nil, err
+	}
+	return append(plan, leftovers...), nil
+}
+
+// findDotGits returns the paths, relative to dir, of the .git files and
+// directories of the repository checked out in dir and of its nested
+// repositories.
+func findDotGits(dir string) ([]string, error) {
+	dotgits := []string{}
+	err := filepath.Walk(dir, func(fname string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Name() != ".git" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, fname)
+		if err != nil {
+			return err
+		}
+		dotgits = append(dotgits, rel)
+		if fi.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return dotgits, err
+}
+
+// commitPlan returns the actions committing the staged changes with
+// message msg, and then the new gitlink in supers. It returns no action
+// with -no-commit.
+func commitPlan(msg string, supers []superproject) ([]action, error) {
+	if *g_no_commit {
+		return nil, nil
+	}
+
+	plan := []action{
+		commitAction("", msg),
+	}
+
+	// commit the new gitlink in all the superprojects of this one
+	smsg := msg
+	for _, super := range supers {
+		sindex, err := gitPath(super.top, "index")
+		if err != nil {
+			return nil, err
+		}
+		smsg = fmt.Sprintf("updated submodule [%s]\n\n%s", super.sub, smsg)
+		plan = append(plan,
+			snapshot(gitActionIn(super.top, "add", "--", super.sub), sindex),
+			commitAction(super.top, smsg, "--", super.sub),
+		)
+	}
+	return plan, nil
+}
+
+// printPlan prints the actions of plan, to be run in directory top, and
+// the commit message msg, for -dry-run.
+func printPlan(top string, plan []action, msg string) {
+	fmt.Printf("in [%s]:\n", top)
+	for _, a := range plan {
+		fmt.Printf("  %s\n", a.desc)
+	}
+	if !*g_no_commit {
+		fmt.Printf("with commit message:\n")
+		for _, line := range strings.Split(strings.TrimRight(msg, "\n"), "\n") {
+			fmt.Printf("  | %s\n", line)
+		}
+	}
+}
+
+// runPlan runs the actions of plan in order. If one fails, the ones
+// already run are undone in reverse order.
+func runPlan(plan []action) error {
+	for i, a := range plan {
+		err := a.run()
+		if err == nil {
+			continue
+		}
+		err = fmt.Errorf("%s: %v", a.desc, err)
+		for j := i - 1; j >= 0; j-- {
+			if plan[j].undo == nil {
+				continue
+			}
+			uerr := plan[j].undo()
+			if uerr != nil {
+				fmt.Fprintf(os.Stderr, "**error**: could not undo [%s]: %v\n", plan[j].desc, uerr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// EOF
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mana-fwk/git-tools/utils"
+)
+
+// gitfileDir returns the git directory a .git file points to (see
+// gitrepository-layout(5)), or an empty string if fname is not a gitfile.
+func gitfileDir(fname string) (string, error) {
+	fi, err := os.Stat(fname)
+	if err != nil || fi.IsDir() {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return "", err
+	}
+	line := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(line, "gitdir:") {
+		return "", fmt.Errorf("invalid gitfile [%s]", fname)
+	}
+	dir := filepath.FromSlash(strings.TrimSpace(strings.TrimPrefix(line, "gitdir:")))
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(fname), dir)
+	}
+	return filepath.Abs(dir)
+}
+
+// isWithin returns whether fname is dir or is under dir.
+func isWithin(dir, fname string) bool {
+	rel, err := filepath.Rel(dir, fname)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// moduleDir returns the git directory of sub, checked out in directory dir,
+// if it belongs to the repository whose git directory is gitdir: the one
+// the .git file of dir points to, or else <gitdir>/modules/<name> (or
+// <path>, for repositories created by older versions of git). It is empty
+// if there is none. A .git file pointing outside of gitdir is returned as
+// external: that git directory is not ours to remove.
+func moduleDir(gitdir, dir string, sub submodule) (moddir, external string, err error) {
+	linked, err := gitfileDir(filepath.Join(dir, ".git"))
+	if err != nil {
+		return "", "", err
+	}
+	if linked != "" {
+		if !isWithin(gitdir, linked) {
+			return "", linked, nil
+		}
+		if utils.PathExists(linked) {
+			return linked, "", nil
+		}
+	}
+	for _, mod := range []string{sub.name, sub.path} {
+		moddir := filepath.Join(gitdir, "modules", mod)
+		if utils.PathExists(moddir) {
+			return moddir, "", nil
+		}
+	}
+	return "", "", nil
+}
+
+// linkedWorktree is another working tree of the superproject, see
+// git-worktree(1).
+type linkedWorktree struct {
+	dir    string // top directory
+	gitdir string // its own git directory, <common dir>/worktrees/<id>
+}
+
+// linkedWorktrees returns the working trees of the repository at top,
+// but top itself.
+func linkedWorktrees(top string) ([]linkedWorktree, error) {
+	out, err := gitOutput("", "worktree", "list", "--porcelain")
+	if err != nil {
+		return nil, err
+	}
+	// in a submodule, the main working tree is listed as its git directory
+	self, err := gitOutput("", "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return nil, err
+	}
+	wts := []linkedWorktree{}
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, "worktree ") {
+			continue
+		}
+		dir := strings.TrimPrefix(line, "worktree ")
+		if filepath.Clean(dir) == filepath.Clean(top) || !utils.PathExists(dir) {
+			// this one, or a bare or pruned one
+			continue
+		}
+		gitdir, err := gitOutput(dir, "rev-parse", "--absolute-git-dir")
+		if err != nil {
+			return nil, err
+		}
+		if filepath.Clean(gitdir) == filepath.Clean(self) {
+			continue
+		}
+		wts = append(wts, linkedWorktree{dir: dir, gitdir: gitdir})
+	}
+	return wts, nil
+}
+
+// usedIn returns the path of sub in the linked working tree wt, if the
+// branch checked out there still has it: a gitlink in its index, registered
+// in its .gitmodules under the name of sub (it may have been moved). The
+// path is empty if sub is not used there.
+func usedIn(wt linkedWorktree, sub submodule) (string, error) {
+	gitmodules := filepath.Join(wt.dir, ".gitmodules")
+	if !utils.PathExists(gitmodules) {
+		return "", nil
+	}
+	entries, err := gitConfigRegexp(gitmodules, `^submodule\.`+regexp.QuoteMeta(sub.name)+`\.path$`)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		out, err := gitOutput(wt.dir, "ls-files", "--stage", "--full-name", "--", ":(top,literal)"+e.Value)
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(out, "160000 ") {
+			return e.Value, nil
+		}
+	}
+	return "", nil
+}
+
+// worktreePlan returns the actions removing what is left of subs in the
+// per-worktree configuration of the current working tree (at top) and in
+// the linked working trees wts, stale git directories being moved to
+// backups. What is removed is recorded in the backups, to be restored with
+// them. What is still in use in a linked working tree (whose checked out
+// branch has the submodule) or may hold user data (a stale checkout, along
+// with its git directory and configuration) is only reported.
+func worktreePlan(top string, wts []linkedWorktree, subs []submodule, backups []*backup) ([]action, error) {
+	plan := []action{}
+
+	// per-worktree configuration (extensions.worktreeConfig)
+	removeSection := func(dir string, sub submodule) ([]configEntry, error) {
+		config, err := gitPath(dir, "config.worktree")
+		if err != nil {
+			return nil, err
+		}
+		if !utils.PathExists(config) {
+			return nil, nil
+		}
+		entries, err := configSection(config, sub.name)
+		if err != nil || len(entries) == 0 {
+			return nil, err
+		}
+		plan = append(plan, snapshot(gitAction(
+			"config", "-f", config, "--remove-section",
+			fmt.Sprintf("submodule.%s", sub.name),
+		), config))
+		return entries, nil
+	}
+
+	for i, sub := range subs {
+		b := backups[i]
+		entries, err := removeSection("", sub)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			b.info.Worktrees = append(b.info.Worktrees, worktreeBackup{Dir: top, Config: entries})
+		}
+
+		for _, wt := range wts {
+			used, err := usedIn(wt, sub)
+			if err != nil {
+				return nil, err
+			}
+			if used != "" {
+				warnf("submodule [%s] is still used in worktree [%s] (as [%s]): left in place\n", sub.path, wt.dir, used)
+				continue
+			}
+
+			// the safety checks were not run there: keep it usable
+			dir := filepath.Join(wt.dir, filepath.FromSlash(sub.path))
+			if utils.PathExists(filepath.Join(dir, ".git")) {
+				warnf("stale checkout of submodule [%s] in worktree [%s]: left in place\n", sub.path, wt.dir)
+				continue
+			}
+
+			wb := worktreeBackup{Dir: wt.dir}
+			wb.Config, err = removeSection(wt.dir, sub)
+			if err != nil {
+				return nil, err
+			}
+
+			moddir, _, err := moduleDir(wt.gitdir, dir, sub)
+			if err != nil {
+				return nil, err
+			}
+			if moddir != "" {
+				wb.GitDir = moddir
+				plan = append(plan, moveAction(moddir, b.worktreeDir(len(b.info.Worktrees))))
+			}
+			if len(wb.Config) > 0 || wb.GitDir != "" {
+				b.info.Worktrees = append(b.info.Worktrees, wb)
+			}
+		}
+	}
+	return plan, nil
+}
+
+// EOF